@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Sources of banal ngrams: an ngram may be banal for several reasons
+const (
+	pairCommonNgram   uint8 = 1 << iota // among the most frequent ngrams shared by a document pair
+	corpusCommonNgram                   // among the most common ngrams of source or target corpora
+	knownFormulaNgram                   // part of a list of known formulae
+)
+
+var banalitySourceNames = []string{"pair", "corpus", "formula"}
+
+// formulaList is a labeled list of ngrams of known formulae
+type formulaList struct {
+	label  string
+	ngrams map[int64]bool
+}
+
+// Formula modes: passages dominated by a formula list are either flagged as banal or suppressed
+var formulaModes = map[string]bool{"banal": true, "suppress": true}
+
+// formulaLists holds the lists of known formulae, and knownFormulae the ngrams of all lists, always considered banal
+var formulaLists []formulaList
+var knownFormulae map[int64]bool
+
+func checkFormulaMode(mode string) error {
+	if !formulaModes[mode] {
+		return fmt.Errorf("unknown formula mode %s: use banal or suppress", mode)
+	}
+	return nil
+}
+
+// loadFormulaLists reads comma-separated label:path pairs of ngram hash lists. Lists given without a label are labeled formula.
+func loadFormulaLists(lists string) []formulaList {
+	formulae := []formulaList{}
+	for _, list := range strings.Split(lists, ",") {
+		list = strings.TrimSpace(list)
+		if list == "" {
+			continue
+		}
+		label, path, found := strings.Cut(list, ":")
+		if !found {
+			label, path = "formula", list
+		}
+		formulae = append(formulae, formulaList{strings.TrimSpace(label), loadNgramList(strings.TrimSpace(path))})
+	}
+	return formulae
+}
+
+// loadNgramList reads a list of ngram hashes, one per line
+func loadNgramList(filename string) map[int64]bool {
+	file, err := os.Open(filename)
+	checkErr(err, "loadNgramList")
+	defer file.Close()
+	ngrams := make(map[int64]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		ngram, err := strconv.ParseInt(line, 10, 64)
+		checkErr(err, "loadNgramList")
+		ngrams[ngram] = true
+	}
+	return ngrams
+}
+
+// banalitySources lists the names of the sources of a banal ngram, along with the labels of the formula lists it belongs to
+func banalitySources(ngram int64, sources uint8) string {
+	names := []string{}
+	for index, name := range banalitySourceNames {
+		if sources&(1<<index) == 0 {
+			continue
+		}
+		if 1<<index != knownFormulaNgram {
+			names = append(names, name)
+			continue
+		}
+		for _, list := range formulaLists {
+			if list.ngrams[ngram] {
+				names = append(names, name+":"+list.label)
+			}
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// scoreBanality computes the share of banal ngrams among the source ngrams of each alignment also found in its target passage.
+// Since it is computed from passage boundaries, it also holds for merged passages. Passages whose banality score reaches
+// common_ngrams_limit are flagged as banal, and with explainBanality the banal ngrams are listed along with their sources.
+// Passages where the ngrams of a formula list reach formula_limit are labeled with that list, and either flagged as banal
+// or suppressed depending on the formula mode.
+func scoreBanality(alignments []Alignment, sourceFile *docIndex, sourcePositions []int64, targetPositions []int64, banalNgrams map[int64]uint8,
+	ngramIndex map[int64]string, config *matchingParams) []Alignment {
+	keptAlignments := make([]Alignment, 0, len(alignments))
+	for _, alignment := range alignments {
+		targetNgrams := make(map[int64]bool)
+		for position := alignment.target.startNgramIndex; position <= alignment.target.endNgramIndex && position < int64(len(targetPositions)); position++ {
+			targetNgrams[targetPositions[position]] = true
+		}
+		var matchingNgrams, banalMatches int64
+		formulaMatches := make([]int64, len(formulaLists))
+		explanation := []string{}
+		explained := make(map[int64]bool)
+		for position := alignment.source.startNgramIndex; position <= alignment.source.endNgramIndex && position < int64(len(sourcePositions)); position++ {
+			ngram := sourcePositions[position]
+			if ngram == -1 || !targetNgrams[ngram] {
+				continue
+			}
+			matchingNgrams++
+			sources, ok := banalNgrams[ngram]
+			if !ok {
+				continue
+			}
+			banalMatches++
+			if sources&knownFormulaNgram != 0 {
+				for listIndex, list := range formulaLists {
+					if list.ngrams[ngram] {
+						formulaMatches[listIndex]++
+					}
+				}
+			}
+			if config.explainBanality && !explained[ngram] {
+				explained[ngram] = true
+				explanation = append(explanation, ngramText(ngram, sourceFile, position, ngramIndex)+"("+banalitySources(ngram, sources)+")")
+			}
+		}
+		alignment.banalityScore = 0
+		if matchingNgrams > 0 {
+			alignment.banalityScore = float64(banalMatches) / float64(matchingNgrams)
+		}
+		alignment.banality = matchingNgrams > 0 && alignment.banalityScore >= float64(config.commonNgramsLimit)
+		alignment.banalNgrams = strings.Join(explanation, " ")
+		labels := []string{}
+		for listIndex, list := range formulaLists {
+			if matchingNgrams > 0 && float64(formulaMatches[listIndex])/float64(matchingNgrams) >= config.formulaLimit {
+				labels = append(labels, list.label)
+			}
+		}
+		alignment.formulae = strings.Join(labels, ",")
+		if len(labels) > 0 {
+			if config.formulaMode == "suppress" {
+				continue
+			}
+			alignment.banality = true
+		}
+		keptAlignments = append(keptAlignments, alignment)
+	}
+	return keptAlignments
+}
+
+// ngramText returns the ngram found at a position of a document as it appears in the ngram index, or its hash
+// if the index is not loaded. Ngrams re-indexed for fuzzy or cross-language matching are looked up by their original hash.
+func ngramText(ngram int64, doc *docIndex, position int64, ngramIndex map[int64]string) string {
+	if originalHash, ok := doc.Variants[position]; ok {
+		ngram = originalHash
+	} else if originalHash, ok := doc.Translations[position]; ok {
+		ngram = originalHash
+	}
+	if text, ok := ngramIndex[ngram]; ok {
+		return text
+	}
+	return strconv.FormatInt(ngram, 10)
+}
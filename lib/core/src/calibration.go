@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"sort"
+)
+
+// Calibration modes: shuffle compares sampled document pairs after shuffling the ngram positions of the target,
+// disjoint compares sampled pairs of source and target files assumed to share no text
+var calibrationModes = map[string]bool{"": true, "shuffle": true, "disjoint": true}
+
+// calibrationReport summarizes the passages found in document pairs which share no text
+type calibrationReport struct {
+	Mode                             string        `json:"mode"`
+	Pairs                            int           `json:"pairs"`
+	FalsePositivePassages            int           `json:"false_positive_passages"`
+	FalsePositivesPerPair            float64       `json:"false_positives_per_pair"`
+	PairsWithFalsePositives          int           `json:"pairs_with_false_positives"`
+	CurrentMinimumMatchingNgrams     int64         `json:"current_minimum_matching_ngrams"`
+	TargetErrorRate                  float64       `json:"target_error_rate"`
+	RecommendedMinimumMatchingNgrams int64         `json:"recommended_minimum_matching_ngrams"`
+	Thresholds                       []errorAtSize `json:"thresholds"`
+}
+
+// errorAtSize is the false-positive rate observed for a minimum_matching_ngrams value
+type errorAtSize struct {
+	MinimumMatchingNgrams int64   `json:"minimum_matching_ngrams"`
+	FalsePositivesPerPair float64 `json:"false_positives_per_pair"`
+}
+
+func checkCalibrationMode(mode string) error {
+	if !calibrationModes[mode] {
+		return fmt.Errorf("unknown calibration mode %s: use shuffle or disjoint", mode)
+	}
+	return nil
+}
+
+// samplePairs draws random pairs of distinct documents
+func samplePairs(sourceFiles []sortedFile, targetFiles []sortedFile, pairs int, random *rand.Rand) [][2]sortedFile {
+	sampledPairs := [][2]sortedFile{}
+	for attempts := 0; len(sampledPairs) < pairs && attempts < pairs*10; attempts++ {
+		sourceFile := sourceFiles[random.Intn(len(sourceFiles))]
+		targetFile := targetFiles[random.Intn(len(targetFiles))]
+		if sourceFile.docID != targetFile.docID {
+			sampledPairs = append(sampledPairs, [2]sortedFile{sourceFile, targetFile})
+		}
+	}
+	return sampledPairs
+}
+
+// shufflePositions moves every ngram occurrence of a document to a random position, which keeps
+// ngram frequencies while destroying any shared sequence
+func shufflePositions(doc *docIndex, random *rand.Rand) docIndex {
+	keys := make([]int64, 0, len(doc.Ngrams))
+	occurrences := []indexedNgram{}
+	for ngram := range doc.Ngrams {
+		keys = append(keys, ngram)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, ngram := range keys {
+		occurrences = append(occurrences, doc.Ngrams[ngram]...)
+	}
+	random.Shuffle(len(occurrences), func(i, j int) { occurrences[i], occurrences[j] = occurrences[j], occurrences[i] })
+	shuffled := *doc
+	shuffled.Ngrams = make(map[int64][]indexedNgram, len(keys))
+	shuffled.Variants = make(map[int64]int64, len(doc.Variants))
+	shuffled.Translations = make(map[int64]int64, len(doc.Translations))
+	position := 0
+	for _, ngram := range keys {
+		count := len(doc.Ngrams[ngram])
+		shuffled.Ngrams[ngram] = append([]indexedNgram{}, occurrences[position:position+count]...)
+		for index, occurrence := range doc.Ngrams[ngram] { // original hashes of fuzzy or translation keys follow their key
+			if hash, ok := doc.Variants[occurrence.index]; ok {
+				shuffled.Variants[shuffled.Ngrams[ngram][index].index] = hash
+			}
+			if hash, ok := doc.Translations[occurrence.index]; ok {
+				shuffled.Translations[shuffled.Ngrams[ngram][index].index] = hash
+			}
+		}
+		position += count
+	}
+	return shuffled
+}
+
+// runCalibration aligns document pairs which share no text with a minimum of one matching ngram, then counts the
+// chance passages which would pass each minimum_matching_ngrams value. The report is printed and written
+// to calibration.json, along with the smallest minimum_matching_ngrams keeping false positives below the target rate.
+func runCalibration(sourceFiles []sortedFile, targetFiles []sortedFile, config *matchingParams) {
+	random := rand.New(rand.NewSource(config.calibrationSeed))
+	if config.calibrate == "disjoint" && len(targetFiles) == 0 {
+		checkErr(fmt.Errorf("disjoint calibration requires target files unrelated to source files"), "runCalibration")
+	}
+	if len(targetFiles) == 0 {
+		targetFiles = sourceFiles
+	}
+	pairs := samplePairs(sourceFiles, targetFiles, config.calibrationPairs, random)
+	if len(pairs) == 0 {
+		checkErr(fmt.Errorf("no document pair to calibrate on"), "runCalibration")
+	}
+	sourceSample, targetSample := []sortedFile{}, []sortedFile{}
+	seenSources, seenTargets := map[string]bool{}, map[string]bool{}
+	for _, pair := range pairs {
+		if !seenSources[pair[0].docID] {
+			seenSources[pair[0].docID] = true
+			sourceSample = append(sourceSample, pair[0])
+		}
+		if !seenTargets[pair[1].docID] {
+			seenTargets[pair[1].docID] = true
+			targetSample = append(targetSample, pair[1])
+		}
+	}
+	sourceDocs := make(map[string]*docIndex)
+	for index, doc := range loadCalibrationDocs(sourceSample, "Loading source files", false, config.numThreads) {
+		sourceDocs[sourceSample[index].docID] = doc
+	}
+	targetDocs := make(map[string]*docIndex)
+	for index, doc := range loadCalibrationDocs(targetSample, "Loading target files", true, config.numThreads) {
+		targetDocs[targetSample[index].docID] = doc
+	}
+
+	calibrationConfig := *config
+	calibrationConfig.minimumMatchingNgrams = 1
+	calibrationConfig.debug = false
+	passageSizes := []int64{}
+	pairsWithFalsePositives := 0
+	fmt.Printf("Aligning %d document pairs which share no text...", len(pairs))
+	for _, pair := range pairs {
+		sourceFile, targetFile := sourceDocs[pair[0].docID], targetDocs[pair[1].docID]
+		if config.calibrate == "shuffle" {
+			shuffledTarget := shufflePositions(targetFile, random)
+			targetFile = &shuffledTarget
+		}
+		intersection, _ := getIntersection(sourceFile, targetFile)
+		if len(intersection) < config.minimumMatchingNgramsInDocs {
+			continue
+		}
+		matches := getMatches(sourceFile, targetFile, intersection)
+		var alignments []Alignment
+		if config.matchingMode == "unordered" {
+			alignments = matchPassageUnordered(matches, &calibrationConfig)
+		} else {
+			alignments = matchPassage(sourceFile, targetFile, matches, &calibrationConfig, map[int64]string{}, nil)
+		}
+		if config.mergeOnByteDistance || config.mergeOnNgramDistance {
+			alignments = mergeWithPrevious(alignments, &calibrationConfig, nil)
+		}
+		falsePositive := false
+		for _, alignment := range alignments {
+			passageSizes = append(passageSizes, alignment.totalMatchingNgrams)
+			if alignment.totalMatchingNgrams >= config.minimumMatchingNgrams {
+				falsePositive = true
+			}
+		}
+		if falsePositive {
+			pairsWithFalsePositives++
+		}
+	}
+	fmt.Println(" done.")
+
+	report := calibrationReport{Mode: config.calibrate, Pairs: len(pairs), PairsWithFalsePositives: pairsWithFalsePositives,
+		CurrentMinimumMatchingNgrams: config.minimumMatchingNgrams, TargetErrorRate: config.targetErrorRate}
+	sort.Slice(passageSizes, func(i, j int) bool { return passageSizes[i] < passageSizes[j] })
+	var largestSize int64 = 1
+	if len(passageSizes) > 0 {
+		largestSize = passageSizes[len(passageSizes)-1]
+	}
+	for threshold := int64(1); threshold <= largestSize+1; threshold++ {
+		firstPassing := sort.Search(len(passageSizes), func(i int) bool { return passageSizes[i] >= threshold })
+		errorRate := float64(len(passageSizes)-firstPassing) / float64(len(pairs))
+		report.Thresholds = append(report.Thresholds, errorAtSize{threshold, errorRate})
+		if threshold == config.minimumMatchingNgrams {
+			report.FalsePositivePassages = len(passageSizes) - firstPassing
+			report.FalsePositivesPerPair = errorRate
+		}
+		if report.RecommendedMinimumMatchingNgrams == 0 && errorRate <= config.targetErrorRate {
+			report.RecommendedMinimumMatchingNgrams = threshold
+		}
+	}
+	if config.minimumMatchingNgrams > largestSize+1 {
+		report.FalsePositivesPerPair = 0
+	}
+
+	fmt.Printf("False positives with minimum_matching_ngrams = %d: %d passages in %d of %d document pairs (%.4f per pair)\n",
+		config.minimumMatchingNgrams, report.FalsePositivePassages, pairsWithFalsePositives, len(pairs), report.FalsePositivesPerPair)
+	fmt.Printf("Recommended minimum_matching_ngrams for at most %g false positives per pair: %d\n", config.targetErrorRate, report.RecommendedMinimumMatchingNgrams)
+	jsonString, _ := json.MarshalIndent(report, "", "  ")
+	err := ioutil.WriteFile(filepath.Join(config.outputPath, "calibration.json"), jsonString, 0644)
+	checkErr(err, "runCalibration")
+}
+
+// loadCalibrationDocs loads sampled documents in the order of the files given
+func loadCalibrationDocs(files []sortedFile, prefixString string, target bool, threads int) []*docIndex {
+	for index := range files {
+		files[index].sortID = index
+	}
+	docs := getJSONDocs(files, prefixString, threads)
+	if translations != nil && target {
+		translations.rekeyTargetDocs(docs)
+	} else if translations != nil {
+		translations.rekeySourceDocs(docs)
+	} else if fuzzyNgrams != nil {
+		for index := range docs {
+			fuzzyNgrams.rekey(&docs[index])
+		}
+	}
+	docPointers := make([]*docIndex, len(docs))
+	for index := range docs {
+		docPointers[index] = &docs[index]
+	}
+	return docPointers
+}
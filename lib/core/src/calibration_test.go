@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestShufflePositionsKeepsCountsAndVariants(t *testing.T) {
+	doc := docIndex{DocID: "1", Ngrams: map[int64][]indexedNgram{
+		10: {{0, 0, 10}, {3, 30, 40}},
+		20: {{1, 10, 20}},
+		30: {{2, 20, 30}, {4, 40, 50}, {5, 50, 60}},
+	}, Variants: map[int64]int64{2: 31, 4: 32, 5: 31}}
+	shuffled := shufflePositions(&doc, rand.New(rand.NewSource(1)))
+	seen := make(map[int64]bool)
+	for ngram, occurrences := range doc.Ngrams {
+		if len(shuffled.Ngrams[ngram]) != len(occurrences) {
+			t.Errorf("ngram %d found %d times after shuffling instead of %d", ngram, len(shuffled.Ngrams[ngram]), len(occurrences))
+		}
+		for _, occurrence := range shuffled.Ngrams[ngram] {
+			if seen[occurrence.index] {
+				t.Errorf("position %d assigned twice", occurrence.index)
+			}
+			seen[occurrence.index] = true
+		}
+	}
+	if len(seen) != 6 {
+		t.Errorf("expected 6 shuffled positions, got %d", len(seen))
+	}
+	variantCounts := make(map[int64]int)
+	for _, occurrence := range shuffled.Ngrams[30] {
+		hash, ok := shuffled.Variants[occurrence.index]
+		if !ok {
+			t.Errorf("variant of ngram 30 lost at position %d", occurrence.index)
+		}
+		variantCounts[hash]++
+	}
+	if len(shuffled.Variants) != 3 || variantCounts[31] != 2 || variantCounts[32] != 1 {
+		t.Errorf("variants did not follow shuffled positions: %v", shuffled.Variants)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var attributeRegex = regexp.MustCompile(`([\w:.-]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+// Abbreviations used for common div types when building citations
+var divTypeLabels = map[string]string{
+	"book": "Book", "part": "Part", "volume": "Vol.", "chapter": "ch.", "section": "sect.",
+	"act": "Act", "scene": "Scene", "canto": "Canto", "letter": "Letter", "article": "art.",
+}
+
+// structuralMarker is a tag used to locate passages in the source XML: page and line breaks,
+// divisions, verse lines and milestones
+type structuralMarker struct {
+	rawOffset int64
+	element   string
+	n         string
+	label     string // type attribute for divs, unit attribute for milestones
+	end       bool
+}
+
+// citationLocator is the position of a byte in the structure of a document
+type citationLocator struct {
+	divs      []string
+	page      string
+	line      string
+	verse     string
+	milestone string
+}
+
+func isStructuralElement(element string) bool {
+	switch element {
+	case "pb", "lb", "l", "milestone", "div":
+		return true
+	}
+	return strings.HasPrefix(element, "div") && len(element) == 4 && element[3] >= '1' && element[3] <= '7'
+}
+
+func newStructuralMarker(rawOffset int64, tag xmlTag) structuralMarker {
+	marker := structuralMarker{rawOffset: rawOffset, element: tag.name, end: tag.end}
+	if tag.end {
+		return marker
+	}
+	marker.n = tag.attribute("n")
+	switch {
+	case tag.name == "milestone":
+		marker.label = tag.attribute("unit")
+	case strings.HasPrefix(tag.name, "div"):
+		marker.label = tag.attribute("type")
+	}
+	return marker
+}
+
+// attribute returns the value of an attribute of the tag, or an empty string if it isn't set
+func (tag xmlTag) attribute(name string) string {
+	for _, attribute := range attributeRegex.FindAllSubmatch(tag.attributes, -1) {
+		if string(attribute[1]) == name {
+			return string(attribute[2]) + string(attribute[3])
+		}
+	}
+	return ""
+}
+
+// locate resolves a raw byte offset to the structural markers enclosing it. Markers are sorted by raw offset,
+// so the locator is the one in effect after the last marker before the offset.
+func (doc *cleanedText) locate(rawByte int64) citationLocator {
+	doc.locatorsOnce.Do(doc.buildLocators)
+	lastMarker := sort.Search(len(doc.markers), func(i int) bool { return doc.markers[i].rawOffset > rawByte })
+	if lastMarker == 0 {
+		return citationLocator{}
+	}
+	return doc.locators[lastMarker-1]
+}
+
+// buildLocators replays the markers of a document once to store the locator in effect after each of them
+func (doc *cleanedText) buildLocators() {
+	doc.locators = make([]citationLocator, len(doc.markers))
+	locator := citationLocator{}
+	var divStack []string
+	linesSincePage := 0
+	for index, marker := range doc.markers {
+		switch {
+		case marker.element == "pb":
+			locator.page = marker.n
+			locator.line = ""
+			linesSincePage = 0
+		case marker.element == "lb":
+			linesSincePage++
+			if marker.n != "" {
+				locator.line = marker.n
+			} else {
+				locator.line = strconv.Itoa(linesSincePage)
+			}
+		case marker.element == "l":
+			if marker.end {
+				locator.verse = ""
+			} else if marker.n != "" {
+				locator.verse = marker.n
+			}
+		case marker.element == "milestone":
+			if marker.n != "" {
+				locator.milestone = strings.TrimSpace(marker.label + " " + marker.n)
+			}
+		default: // divs: verses and milestones do not carry over to another division
+			locator.verse = ""
+			locator.milestone = ""
+			if marker.end {
+				if len(divStack) > 0 {
+					divStack = divStack[:len(divStack)-1]
+				}
+			} else {
+				divStack = append(divStack, divLabel(marker))
+			}
+			locator.divs = nil // locators of previous markers keep their own list of divs
+			for _, div := range divStack {
+				if div != "" {
+					locator.divs = append(locator.divs, div)
+				}
+			}
+		}
+		doc.locators[index] = locator
+	}
+}
+
+func divLabel(marker structuralMarker) string {
+	if marker.n == "" {
+		return ""
+	}
+	if label, ok := divTypeLabels[strings.ToLower(marker.label)]; ok {
+		return label + " " + marker.n
+	} else if marker.label != "" {
+		return strings.ToUpper(marker.label[:1]) + marker.label[1:] + " " + marker.n
+	}
+	return marker.n
+}
+
+// parts returns the components of a citation, from the largest division to the smallest unit
+func (locator citationLocator) parts() []string {
+	parts := append([]string{}, locator.divs...)
+	if locator.milestone != "" {
+		parts = append(parts, locator.milestone)
+	}
+	if locator.page != "" {
+		parts = append(parts, "p. "+locator.page)
+	}
+	if locator.line != "" {
+		parts = append(parts, "l. "+locator.line)
+	}
+	if locator.verse != "" {
+		parts = append(parts, "v. "+locator.verse)
+	}
+	return parts
+}
+
+// citation builds a human readable citation for a passage: the end locator only repeats what differs from the start.
+// Passages starting before the first marker are cited by their end locator alone.
+func citation(start citationLocator, end citationLocator) string {
+	startParts, endParts := start.parts(), end.parts()
+	if len(startParts) == 0 {
+		return strings.Join(endParts, ", ")
+	}
+	firstDifference := 0
+	for firstDifference < len(startParts) && firstDifference < len(endParts) && startParts[firstDifference] == endParts[firstDifference] {
+		firstDifference++
+	}
+	if firstDifference == len(endParts) { // nothing more specific at the end of the passage
+		return strings.Join(startParts, ", ")
+	}
+	return strings.Join(startParts, ", ") + " – " + strings.Join(endParts[firstDifference:], ", ")
+}
+
+// addCitationFields stores the citation of a passage and its structured locators in the output fields
+func addCitationFields(fields map[string]string, prefix string, doc *cleanedText, passagePosition *position) {
+	start := doc.locate(passagePosition.startByte)
+	end := doc.locate(passagePosition.endByte - 1)
+	fields[prefix+"citation"] = citation(start, end)
+	fields[prefix+"start_div"] = strings.Join(start.divs, ", ")
+	fields[prefix+"start_page"] = start.page
+	fields[prefix+"start_line"] = start.line
+	fields[prefix+"start_verse"] = start.verse
+	fields[prefix+"start_milestone"] = start.milestone
+	fields[prefix+"end_div"] = strings.Join(end.divs, ", ")
+	fields[prefix+"end_page"] = end.page
+	fields[prefix+"end_line"] = end.line
+	fields[prefix+"end_verse"] = end.verse
+	fields[prefix+"end_milestone"] = end.milestone
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildLocators(t *testing.T) {
+	raw := `<div type="chapter" n="2"><pb n="14"/><lb/>one<lb/>two<l n="5">verse</l>after` +
+		`<milestone unit="section" n="3"/>ms</div><div type="chapter" n="3">next</div>`
+	decodeRune, _ := getRuneDecoder("utf-8")
+	doc := &cleanedText{rawLength: int64(len(raw))}
+	doc.clean([]byte(raw), decodeRune, cleaningOptions{citations: true})
+	tests := []struct {
+		word     string
+		expected string
+	}{
+		{"one", "ch. 2, p. 14, l. 1"},
+		{"two", "ch. 2, p. 14, l. 2"},
+		{"verse", "ch. 2, p. 14, l. 2, v. 5"},
+		{"after", "ch. 2, p. 14, l. 2"},
+		{"ms", "ch. 2, section 3, p. 14, l. 2"},
+		{"next", "ch. 3, p. 14, l. 2"},
+	}
+	for _, test := range tests {
+		locator := doc.locate(int64(strings.Index(raw, test.word)))
+		if got := strings.Join(locator.parts(), ", "); got != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.word, test.expected, got)
+		}
+	}
+}
+
+func TestCitation(t *testing.T) {
+	chapter := citationLocator{divs: []string{"ch. 2"}, page: "3"}
+	tests := []struct {
+		name       string
+		start, end citationLocator
+		expected   string
+	}{
+		{"no locators", citationLocator{}, citationLocator{}, ""},
+		{"no start locator", citationLocator{}, chapter, "ch. 2, p. 3"},
+		{"same locators", chapter, chapter, "ch. 2, p. 3"},
+		{"range", chapter, citationLocator{divs: []string{"ch. 2"}, page: "4"}, "ch. 2, p. 3 – p. 4"},
+	}
+	for _, test := range tests {
+		if got := citation(test.start, test.end); got != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Selections of common ngrams from corpus document frequencies: the ngrams found in the most documents (count),
+// those whose document frequency reaches a percentile of all document frequencies (percentile), or those found
+// in a share of documents (df_ratio). Without selection, common ngrams are read from common ngram files.
+var commonNgramSelections = map[string]bool{"": true, "count": true, "percentile": true, "df_ratio": true}
+
+func checkCommonNgramSelection(selection string) error {
+	if !commonNgramSelections[selection] {
+		return fmt.Errorf("unknown common ngram selection %s: use count, percentile or df_ratio", selection)
+	}
+	return nil
+}
+
+// selectCommonNgrams selects common ngrams from the document frequencies of the corpus, sorted by decreasing
+// document frequency. Ngrams found in a single document are never common.
+func selectCommonNgrams(stats *corpusStats, config *matchingParams) []int64 {
+	candidates := make([]int64, 0, len(stats.documentFrequency))
+	for ngram, documentFrequency := range stats.documentFrequency {
+		if documentFrequency > 1 {
+			candidates = append(candidates, ngram)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if stats.documentFrequency[candidates[i]] != stats.documentFrequency[candidates[j]] {
+			return stats.documentFrequency[candidates[i]] > stats.documentFrequency[candidates[j]]
+		}
+		return candidates[i] < candidates[j]
+	})
+	var minimumDocumentFrequency int64
+	switch config.commonNgramsSelection {
+	case "count":
+		if len(candidates) > config.mostCommonNgramThreshold {
+			candidates = candidates[:config.mostCommonNgramThreshold]
+		}
+		return candidates
+	case "percentile":
+		documentFrequencies := make([]int64, 0, len(stats.documentFrequency))
+		for _, documentFrequency := range stats.documentFrequency {
+			documentFrequencies = append(documentFrequencies, documentFrequency)
+		}
+		sort.Slice(documentFrequencies, func(i, j int) bool { return documentFrequencies[i] < documentFrequencies[j] })
+		rank := int(math.Ceil(config.commonNgramsPercentile/100*float64(len(documentFrequencies)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		if rank >= len(documentFrequencies) {
+			rank = len(documentFrequencies) - 1
+		}
+		if len(documentFrequencies) > 0 {
+			minimumDocumentFrequency = documentFrequencies[rank]
+		}
+	case "df_ratio":
+		minimumDocumentFrequency = int64(math.Ceil(config.commonNgramsDFRatio * float64(stats.totalDocs)))
+	}
+	selected := sort.Search(len(candidates), func(i int) bool { return stats.documentFrequency[candidates[i]] < minimumDocumentFrequency })
+	return candidates[:selected]
+}
+
+// lookupNgramText reads the text of the given ngrams from index.tab files
+func lookupNgramText(indexLocations []string, ngrams []int64) map[int64]string {
+	wanted := make(map[int64]bool, len(ngrams))
+	for _, ngram := range ngrams {
+		wanted[ngram] = true
+	}
+	ngramText := make(map[int64]string, len(ngrams))
+	for _, indexLocation := range indexLocations {
+		if indexLocation == "" {
+			continue
+		}
+		file, err := os.Open(indexLocation)
+		checkErr(err, "lookupNgramText")
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			values := strings.Split(strings.TrimSpace(scanner.Text()), "\t")
+			if len(values) != 2 {
+				continue
+			}
+			hash, _ := strconv.ParseInt(values[1], 10, 64)
+			if wanted[hash] {
+				ngramText[hash] = values[0]
+			}
+		}
+		file.Close()
+	}
+	return ngramText
+}
+
+// writeCommonNgrams writes selected common ngrams to common_ngrams.txt, one per line, with their text when found in the
+// ngram index, their hash and their document frequency
+func writeCommonNgrams(ngrams []int64, stats *corpusStats, config *matchingParams) {
+	ngramText := lookupNgramText(config.ngramIndexLocations, ngrams)
+	os.MkdirAll(config.outputPath, 0755)
+	file, err := os.Create(filepath.Join(config.outputPath, "common_ngrams.txt"))
+	checkErr(err, "writeCommonNgrams")
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	for _, ngram := range ngrams {
+		writer.WriteString(fmt.Sprintf("%s\t%d\t%d\n", ngramText[ngram], ngram, stats.documentFrequency[ngram]))
+	}
+	writer.Flush()
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectCommonNgrams(t *testing.T) {
+	stats := &corpusStats{documentFrequency: map[int64]int64{1: 10, 2: 8, 3: 8, 4: 5, 5: 2, 6: 1}, totalDocs: 20}
+	tests := []struct {
+		name     string
+		config   matchingParams
+		expected []int64
+	}{
+		{"count", matchingParams{commonNgramsSelection: "count", mostCommonNgramThreshold: 3}, []int64{1, 2, 3}},
+		{"count above candidates", matchingParams{commonNgramsSelection: "count", mostCommonNgramThreshold: 10}, []int64{1, 2, 3, 4, 5}},
+		{"median percentile", matchingParams{commonNgramsSelection: "percentile", commonNgramsPercentile: 50}, []int64{1, 2, 3, 4}},
+		{"top percentile", matchingParams{commonNgramsSelection: "percentile", commonNgramsPercentile: 99}, []int64{1}},
+		{"df ratio", matchingParams{commonNgramsSelection: "df_ratio", commonNgramsDFRatio: 0.4}, []int64{1, 2, 3}},
+		{"df ratio below two documents", matchingParams{commonNgramsSelection: "df_ratio", commonNgramsDFRatio: 0.01}, []int64{1, 2, 3, 4, 5}},
+	}
+	for _, test := range tests {
+		if selected := selectCommonNgrams(stats, &test.config); !reflect.DeepEqual(selected, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, selected)
+		}
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"html"
 	"io/ioutil"
 	"log"
 	"math"
@@ -27,33 +26,51 @@ type sortedFile struct {
 }
 
 type docIndex struct {
-	DocID       string
-	Ngrams      map[int32][]indexedNgram
-	NgramLength int
-	SortID      int
+	DocID        string
+	Ngrams       map[int64][]indexedNgram
+	NgramLength  int
+	SortID       int
+	HashWidth    int
+	Variants     map[int64]int64 // original hash of ngrams moved to a fuzzy or equivalence matching key, by ngram index
+	Translations map[int64]int64 // original hash of ngrams moved to a translation key, by ngram index
+}
+
+// indexHeader declares the width of ngram hashes and offsets used in an ngram index file.
+// Index files without a header are the legacy format, with 32-bit hashes and offsets.
+type indexHeader struct {
+	HashWidth   int `json:"hash_width"`
+	OffsetWidth int `json:"offset_width"`
+}
+
+type headedIndexFile struct {
+	Header indexHeader         `json:"header"`
+	Ngrams map[int64][][]int64 `json:"ngrams"`
 }
 
 type indexedNgram struct {
-	index     int32
-	startByte int32
-	endByte   int32
+	index     int64
+	startByte int64
+	endByte   int64
 }
 
 type ngramMatch struct {
-	source indexedNgram
-	target indexedNgram
-	ngram  int32
+	source     indexedNgram
+	target     indexedNgram
+	ngram      int64
+	fuzzy      bool // source and target ngrams are OCR variants of each other
+	equivalent bool // source and target ngrams are equivalent through the equivalence file
+	translated bool // source ngram was translated through the bilingual dictionary
 }
 
 type matchingParams struct {
-	matchingWindowSize            int32
-	maxGap                        int32
+	matchingWindowSize            int64
+	maxGap                        int64
 	flexGap                       bool
-	minimumMatchingNgrams         int32
-	minimumMatchingNgramsInWindow int32
+	minimumMatchingNgrams         int64
+	minimumMatchingNgramsInWindow int64
 	commonNgramsLimit             float32
 	minimumMatchingNgramsInDocs   int
-	contextSize                   int32
+	contextSize                   int64
 	banalNgrams                   int
 	mergeOnByteDistance           bool
 	mergeOnNgramDistance          bool
@@ -64,43 +81,118 @@ type matchingParams struct {
 	outputPath                    string
 	numThreads                    int
 	sortingField                  string
+	contextMode                   string
+	language                      string
+	textCacheSize                 int
+	excludedElements              string
+	excludedPlaceholder           string
+	citations                     bool
+	sourcePhiloWords              string
+	targetPhiloWords              string
+	sourcePhiloDBLink             string
+	targetPhiloDBLink             string
+	philoLinkTemplate             string
+	rollupLevels                  string
+	refineBoundaries              bool
+	refinementWindow              int
+	verifyAlignments              bool
+	localAlignmentScores          localAlignmentScores
+	minimumAlignmentScore         int64
+	minimumIdentity               float64
+	includeDiff                   bool
+	fuzzyMatching                 bool
+	equivalenceFile               string
+	equivalentMatchWeight         float64
+	paraphraseThreshold           float64
+	bilingualDictionary           string
+	matchingMode                  string
+	reorderTolerance              int64
+	compositeDistance             int64
+	manyToMany                    bool
+	selfAlignment                 bool
+	selfAlignmentMinDistance      int64
+	significance                  bool
+	maxPValue                     float64
+	minimumSignificance           float64
+	idfScoring                    bool
+	rareNgramRatio                float64
+	minimumIDFScore               float64
+	minimumNormalizedIDFScore     float64
+	minimumRareAnchors            int64
+	explainBanality               bool
+	commonNgramsSelection         string
+	mostCommonNgramThreshold      int
+	commonNgramsPercentile        float64
+	commonNgramsDFRatio           float64
+	ngramIndexLocations           []string
+	formulaMode                   string
+	formulaLimit                  float64
+	calibrate                     string
+	calibrationPairs              int
+	targetErrorRate               float64
+	calibrationSeed               int64
+	sourceEncoding                string
+	targetEncoding                string
 	debug                         bool
 }
 
 type matchValues struct {
-	inAlignment               bool
-	matchesInCurrentAlignment int32
-	matchesInCurrentWindow    int32
-	sourceAnchor              int32
-	lastSourcePosition        int32
-	targetAnchor              int32
-	lastTargetPosition        int32
-	previousSourceIndex       int32
-	commonNgramMatches        int32
-	maxSourceGap              int32
-	maxTargetGap              int32
-	sourceWindowBoundary      int32
-	targetWindowBoundary      int32
-	currentAlignment          Alignment
-	previousAlignment         Alignment
-	firstMatch                []indexedNgram
-	lastMatch                 []indexedNgram
-	debug                     []string // the string is the original ngram
+	inAlignment                bool
+	matchesInCurrentAlignment  int64
+	matchesInCurrentWindow     int64
+	sourceAnchor               int64
+	lastSourcePosition         int64
+	targetAnchor               int64
+	lastTargetPosition         int64
+	previousSourceIndex        int64
+	fuzzyMatches               int64
+	equivalentMatches          int64
+	translatedMatches          int64
+	rareAnchors                int64
+	rareAnchorsInCurrentWindow int64
+	maxSourceGap               int64
+	maxTargetGap               int64
+	sourceWindowBoundary       int64
+	targetWindowBoundary       int64
+	currentAlignment           Alignment
+	previousAlignment          Alignment
+	firstMatch                 []indexedNgram
+	lastMatch                  []indexedNgram
+	debug                      []string // the string is the original ngram
 }
 
 // Alignment is the matching representation
 type Alignment struct {
 	source              position
 	target              position
-	totalMatchingNgrams int32
+	totalMatchingNgrams int64
 	banality            bool
+	banalityScore       float64 // share of banal ngrams among matching ngrams
+	banalNgrams         string  // banal matching ngrams along with the sources of their banality
+	formulae            string  // labels of the formula lists dominating the passage
+	refined             bool    // boundaries were adjusted by token-level refinement
+	alignmentScore      int64
+	identity            float64 // percentage of identical tokens in the local alignment of source and target
+	fuzzyMatches        int64   // matching ngrams which are OCR variants of each other
+	equivalentMatches   int64   // matching ngrams which are equivalent through synonyms or lemmas
+	translatedMatches   int64   // matching ngrams translated through the bilingual dictionary
+	reordered           bool    // target matches are not in the same order as source matches
+	compositeGroup      int     // composite borrowing the passage belongs to among alignments of the same pair, 0 if none
+	sourceOccurrences   int     // passages of the same document pair overlapping the source passage, including this one
+	targetOccurrences   int     // passages of the same document pair overlapping the target passage, including this one
+	pValue              float64 // probability of finding as many matching ngrams by chance
+	significance        float64 // negative base 10 log of the p-value
+	idfScore            float64 // sum of the inverse document frequencies of matching ngrams
+	rareNgrams          int64   // matching ngrams found in few documents of the corpus
+	normalizedIDFScore  float64 // IDF score divided by the number of source ngrams of the passage
+	rareAnchors         int64   // matching ngrams found in few documents of the corpus, counted during matching
 }
 
 type position struct {
-	startByte       int32
-	endByte         int32
-	startNgramIndex int32
-	endNgramIndex   int32
+	startByte       int64
+	endByte         int64
+	startNgramIndex int64
+	endNgramIndex   int64
 }
 
 type alignmentsPerDoc struct {
@@ -117,7 +209,7 @@ type CombinedAlignments struct {
 
 // Pair is a data structure to hold a key/value pair.
 type Pair struct {
-	Key   int32
+	Key   int64
 	Value int
 }
 
@@ -129,7 +221,7 @@ func (p PairList) Len() int           { return len(p) }
 func (p PairList) Less(i, j int) bool { return p[i].Value > p[j].Value }
 
 // A function to turn a map into a PairList, then sort and return it.
-func sortMapByValue(m map[int32]int) PairList {
+func sortMapByValue(m map[int64]int) PairList {
 	p := make(PairList, len(m))
 	i := 0
 	for k, v := range m {
@@ -139,22 +231,45 @@ func sortMapByValue(m map[int32]int) PairList {
 	return p
 }
 
-var tags = regexp.MustCompile("<[^>]*?>")
-var brokenBeginTags = regexp.MustCompile("^[^<]*?>")
-var brokenEndTags = regexp.MustCompile("<[^>]*?$")
-var spaces = regexp.MustCompile(" +")
 var spaceChars = regexp.MustCompile(`[\s\r\n\t]+`)
-var tabEntities = regexp.MustCompile("(&#9;)+")
 var cleanStart = regexp.MustCompile(`^\S+ `)
 var cleanEnd = regexp.MustCompile(` \S+$`)
 
 func main() {
 	sourceFiles, targetFiles, sourceMetadata, targetMetadata, commonNgrams, config, ngramIndex := parseFlags()
+	documentTexts = newTextStore(config.textCacheSize, cleaningOptions{parseElementList(config.excludedElements), config.excludedPlaceholder, config.citations})
+	if config.sourcePhiloWords != "" {
+		if len(targetFiles) == 0 || config.targetPhiloWords == "" {
+			config.targetPhiloWords = config.sourcePhiloWords
+			config.targetPhiloDBLink = config.sourcePhiloDBLink
+		}
+		philoDocuments = newPhiloStore(config.sourcePhiloWords, config.targetPhiloWords, config.textCacheSize)
+	}
+	if config.minimumRareAnchors > 0 || (config.calibrate == "" && (config.significance || config.idfScoring || config.commonNgramsSelection != "")) { // calibration only needs frequencies for rare anchors
+		corpusNgrams = computeCorpusStats(sourceFiles, targetFiles, config)
+	}
+	if config.calibrate != "" {
+		os.MkdirAll(config.outputPath, 0755)
+		runCalibration(sourceFiles, targetFiles, config)
+		return
+	}
+	if config.commonNgramsSelection != "" {
+		selectedNgrams := selectCommonNgrams(corpusNgrams, config)
+		writeCommonNgrams(selectedNgrams, corpusNgrams, config)
+		commonNgrams = make(map[int64]bool, len(selectedNgrams))
+		for _, ngram := range selectedNgrams {
+			commonNgrams[ngram] = true
+		}
+		fmt.Printf("Selected %d common ngrams from document frequencies.\n", len(selectedNgrams))
+	}
 	_ = alignPassages(sourceFiles, targetFiles, sourceMetadata, targetMetadata, commonNgrams, config, ngramIndex)
+	if config.rollupLevels != "" {
+		rollUpAlignments(config)
+	}
 	// mergeAlignments(config, counts)
 }
 
-func parseFlags() ([]sortedFile, []sortedFile, map[string]map[string]string, map[string]map[string]string, map[int32]bool, *matchingParams, map[int32]string) {
+func parseFlags() ([]sortedFile, []sortedFile, map[string]map[string]string, map[string]map[string]string, map[int64]bool, *matchingParams, map[int64]string) {
 	outputPath := flag.String("output_path", "./output", "output path for results")
 	ngramIndexLocation := flag.String("ngram_index", "", "location of ngram index used for debugging. Should be the source or target index, not matter which since it'll be used for common ngrams")
 	sourceFilesArg := flag.String("source_files", "", "source files location")
@@ -175,22 +290,173 @@ func parseFlags() ([]sortedFile, []sortedFile, map[string]map[string]string, map
 	minimumMatchingNgrams := flag.Int("minimum_matching_ngrams", 4, "minimum matching ngrams to constitue a match")
 	minimumMatchingNgramsInWindow := flag.Int("minimum_matching_ngrams_in_window", 4, "minimum matching ngrams per sliding window")
 	minimumMatchingNgramsInDocs := flag.Int("minimum_matching_ngrams_in_docs", 4, "minimum unique ngrams matching between docs to start comparison")
-	contextSize := flag.Int("context_size", 300, "size of context for before and after matching passages")
+	contextSize := flag.Int("context_size", 300, "size of context for before and after matching passages, in the unit defined by context_mode")
+	contextMode := flag.String("context_mode", "bytes", "unit of context around passages: bytes, tokens, sentences, or paragraph to use the enclosing XML paragraph")
+	language := flag.String("language", "", "language of texts, used to find sentence boundaries when context_mode is sentences")
 	banalNgrams := flag.Int("banal_ngrams", 25, "The top banal ngrams between two docs: used to define common, or banal ngrams")
 	duplicateThreshold := flag.Int("duplicate_threshold", 80, "dismiss comparison if two texts share n or more percent of ngrams")
 	mergeOnByteDistance := flag.Bool("merge_passages_on_byte_distance", true, "Merge passages within x number of byte: number defined by passage length and the passage_distance_multiplier option. Value between 0 and 1")
 	mergeOnNgramDistance := flag.Bool("merge_passages_on_ngram_distance", true, "Merge passages within x number of ngrams: the value used is the matching_window_size defaulting to 20")
 	passageDistance := flag.Float64("passage_distance_multiplier", 0.5, "Combine passage which are within (multiplier*length of previous passage) bytes")
+	textCacheSize := flag.Int("text_cache_size", 100, "maximum number of cleaned texts kept in memory when extracting passages")
+	excludedElements := flag.String("excluded_elements", "", "comma separated list of XML elements whose content is dropped from passages and contexts, such as note,fw")
+	excludedPlaceholder := flag.String("excluded_placeholder", "", "text inserted in passages where the content of an excluded element was dropped")
+	citations := flag.Bool("citations", false, "resolve passages to page, line and div markers of the source XML and output a citation for each passage")
+	sourcePhiloWords := flag.String("source_philo_words", "", "path to the data/words_and_philo_ids directory of the source PhiloLogic database: used to output the philo_id of objects containing passages")
+	targetPhiloWords := flag.String("target_philo_words", "", "path to the data/words_and_philo_ids directory of the target PhiloLogic database")
+	sourcePhiloDBLink := flag.String("source_philo_db_link", "", "URL of the source PhiloLogic database, used to build links to passages")
+	targetPhiloDBLink := flag.String("target_philo_db_link", "", "URL of the target PhiloLogic database, used to build links to passages")
+	philoLinkTemplate := flag.String("philo_link_template", "{db_link}/navigate/{philo_id}", "template of links to PhiloLogic objects: {db_link} and {philo_id} are replaced")
+	rollupLevels := flag.String("rollup_levels", "", "comma separated list of levels to which alignments are rolled up: PhiloLogic object levels (doc, div1, div2...) or metadata fields holding parent IDs")
+	refineBoundaries := flag.Bool("refine_boundaries", false, "extend or trim passage boundaries to the maximal span of identical source and target tokens")
+	refinementWindow := flag.Int("refinement_window", 5, "number of tokens around passage boundaries compared when refining boundaries")
+	verifyAlignments := flag.Bool("verify_alignments", false, "verify passages with a token-level local alignment (Smith-Waterman) and output its score and identity percentage")
+	matchScore := flag.Int("match_score", 2, "local alignment score of two identical tokens")
+	mismatchScore := flag.Int("mismatch_score", -1, "local alignment score of two different tokens")
+	gapScore := flag.Int("gap_score", -1, "local alignment score of a token aligned with a gap")
+	minimumAlignmentScore := flag.Int("minimum_alignment_score", 0, "dismiss passages whose local alignment score is below this value")
+	minimumIdentity := flag.Float64("minimum_identity", 0, "dismiss passages whose percentage of identical tokens in the local alignment is below this value")
+	includeDiff := flag.Bool("include_diff", false, "include a word-level diff of source and target passages in the output")
+	targetNgramIndexLocation := flag.String("target_ngram_index", "", "location of the target ngram index: used along with --ngram_index to build the token similarity table of fuzzy matching")
+	fuzzyMatching := flag.Bool("fuzzy_matching", false, "also match ngrams whose tokens are OCR variants: tokens sharing a normalized skeleton or within fuzzy_max_distance edits")
+	fuzzyMaxDistance := flag.Int("fuzzy_max_distance", 1, "maximum edit distance between two tokens considered as OCR variants")
+	fuzzyMinTokenLength := flag.Int("fuzzy_min_token_length", 5, "minimum length of tokens considered as OCR variants for fuzzy matching")
+	equivalenceFile := flag.String("equivalence_file", "", "path to a file of equivalent tokens or ngrams, such as synonyms or lemma maps, one class per line: equivalent ngrams are matched")
+	equivalentMatchWeight := flag.Float64("equivalent_match_weight", 0.5, "weight of matches between equivalent ngrams when counting matching ngrams against minimum_matching_ngrams")
+	paraphraseThreshold := flag.Float64("paraphrase_threshold", 0.2, "share of equivalent matching ngrams above which a passage is classified as paraphrastic rather than verbatim")
+	bilingualDictionary := flag.String("bilingual_dictionary", "", "path to a bilingual dictionary, one source token followed by its translations per line: source ngrams are translated before comparison with target ngrams, regardless of word order within ngrams, and matching switches to the unordered mode")
+	matchingMode := flag.String("matching_mode", "monotonic", "monotonic requires target matches in the same order as source matches, unordered scores windows by shared ngrams regardless of their order")
+	reorderTolerance := flag.Int("reorder_tolerance", 15, "in unordered mode, number of ngrams a target match may precede the start of the passage in the target")
+	compositeDistance := flag.Int("composite_distance", 0, "link passages between the same source and target within this number of bytes of each other in both texts and either out of source order in the target or split apart by unmatched target text into composite borrowings: 0 disables detection")
+	manyToMany := flag.Bool("many_to_many", false, "align every target occurrence of a reused source passage, and every source of a target passage, within a document pair")
+	selfAlignment := flag.Bool("self_alignment", false, "when comparing source files against themselves, also compare each file with itself to find passages repeated within the same text")
+	selfAlignmentMinDistance := flag.Int("self_alignment_min_distance", 30, "minimum distance in ngrams between two occurrences of a passage repeated within the same text")
+	significance := flag.Bool("significance", false, "compute corpus ngram frequencies to output the probability of finding each passage by chance (p_value) and a significance score")
+	maxPValue := flag.Float64("max_p_value", 0, "dismiss passages whose p-value is above this value: 0 disables the filter")
+	minimumSignificance := flag.Float64("minimum_significance_score", 0, "dismiss passages whose significance score, the negative log10 of their p-value, is below this value")
+	significanceMinimumNgrams := flag.Int("significance_minimum_matching_ngrams", 2, "minimum matching ngrams of candidate passages used instead of minimum_matching_ngrams when passages are filtered by significance")
+	idfScoring := flag.Bool("idf_scoring", false, "compute the document frequency of ngrams across the corpus to output an IDF-weighted score, the number of rare matching ngrams and a length-normalized score for each passage")
+	rareNgramRatio := flag.Float64("rare_ngram_ratio", 0.01, "share of documents an ngram may appear in to be counted as rare: ngrams found in two documents are always rare")
+	minimumIDFScore := flag.Float64("minimum_idf_score", 0, "dismiss passages whose IDF-weighted score is below this value")
+	minimumNormalizedIDFScore := flag.Float64("minimum_normalized_idf_score", 0, "dismiss passages whose length-normalized IDF score is below this value")
+	knownFormulaeLists := flag.String("known_formulae", "", "comma-separated label:path pairs of lists of ngram hashes of known formulae, one per line, always considered banal")
+	formulaMode := flag.String("formula_mode", "banal", "passages dominated by a list of known formulae are either flagged as banal (banal) or suppressed (suppress)")
+	formulaLimit := flag.Float64("formula_limit", 0.5, "share of matching ngrams from a list of known formulae above which a passage is dominated by this list")
+	explainBanality := flag.Bool("explain_banality", false, "output the banal matching ngrams of each passage along with the source of their banality: pair, corpus or formula. Ngrams are output as text when the --ngram_index option is provided")
+	minimumRareAnchors := flag.Int("minimum_rare_anchors", 0, "minimum number of matching ngrams found in at most rare_ngram_ratio of documents required for a passage: 0 disables the requirement")
+	commonNgramsSelection := flag.String("common_ngrams_selection", "", "select common ngrams from the document frequencies of loaded source and target files instead of common ngram files: count keeps the most_common_ngram_threshold most frequent, percentile those reaching common_ngrams_percentile, df_ratio those found in common_ngrams_df_ratio of documents")
+	commonNgramsPercentile := flag.Float64("common_ngrams_percentile", 99, "percentile of ngram document frequencies from which ngrams are common, with common_ngrams_selection=percentile")
+	commonNgramsDFRatio := flag.Float64("common_ngrams_df_ratio", 0.1, "share of documents from which ngrams are common, with common_ngrams_selection=df_ratio")
+	calibrate := flag.String("calibrate", "", "instead of aligning, estimate false positives on document pairs sharing no text: shuffle the ngram positions of sampled targets, or use disjoint source and target corpora")
+	calibrationPairs := flag.Int("calibration_pairs", 200, "number of document pairs sampled for calibration")
+	targetErrorRate := flag.Float64("target_error_rate", 0.01, "false positive passages per document pair tolerated when recommending minimum_matching_ngrams")
+	calibrationSeed := flag.Int("calibration_seed", 1, "seed of the random sampling and shuffling used for calibration")
+	sourceEncoding := flag.String("source_encoding", "utf-8", "encoding of source text files: utf-8, latin-1 or windows-1252. Passages are always output in UTF-8")
+	targetEncoding := flag.String("target_encoding", "utf-8", "encoding of target text files: utf-8, latin-1 or windows-1252. Passages are always output in UTF-8")
 	debugArg := flag.String("debug", "false", "set debugging: you need to also provide the --ngram_index option with a path to the ngram index to debug the matching logic.")
 	flag.Parse()
 	debug, _ := strconv.ParseBool(*debugArg)
-	config := &matchingParams{int32(*matchingWindowSize), int32(*maxGap), *flexGap, int32(*minimumMatchingNgrams), int32(*minimumMatchingNgramsInWindow), float32(*commonNgramsLimit) / 100, *minimumMatchingNgramsInDocs,
-		int32(*contextSize), *banalNgrams, *mergeOnByteDistance, *mergeOnNgramDistance, float64(*passageDistance), float64(*duplicateThreshold), *sourceBatch, *targetBatch, *outputPath, *threadsArg, *sortField, debug}
-	ngramIndex := make(map[int32]string)
-	if config.debug && *ngramIndexLocation != "" {
+	config := &matchingParams{
+		matchingWindowSize:            int64(*matchingWindowSize),
+		maxGap:                        int64(*maxGap),
+		flexGap:                       *flexGap,
+		minimumMatchingNgrams:         int64(*minimumMatchingNgrams),
+		minimumMatchingNgramsInWindow: int64(*minimumMatchingNgramsInWindow),
+		commonNgramsLimit:             float32(*commonNgramsLimit) / 100,
+		minimumMatchingNgramsInDocs:   *minimumMatchingNgramsInDocs,
+		contextSize:                   int64(*contextSize),
+		banalNgrams:                   *banalNgrams,
+		mergeOnByteDistance:           *mergeOnByteDistance,
+		mergeOnNgramDistance:          *mergeOnNgramDistance,
+		passageDistanceMultiplier:     float64(*passageDistance),
+		duplicateThreshold:            float64(*duplicateThreshold),
+		sourceBatch:                   *sourceBatch,
+		targetBatch:                   *targetBatch,
+		outputPath:                    *outputPath,
+		numThreads:                    *threadsArg,
+		sortingField:                  *sortField,
+		contextMode:                   *contextMode,
+		language:                      *language,
+		textCacheSize:                 *textCacheSize,
+		excludedElements:              *excludedElements,
+		excludedPlaceholder:           *excludedPlaceholder,
+		citations:                     *citations,
+		sourcePhiloWords:              *sourcePhiloWords,
+		targetPhiloWords:              *targetPhiloWords,
+		sourcePhiloDBLink:             *sourcePhiloDBLink,
+		targetPhiloDBLink:             *targetPhiloDBLink,
+		philoLinkTemplate:             *philoLinkTemplate,
+		rollupLevels:                  *rollupLevels,
+		refineBoundaries:              *refineBoundaries,
+		refinementWindow:              *refinementWindow,
+		verifyAlignments:              *verifyAlignments,
+		localAlignmentScores:          localAlignmentScores{int64(*matchScore), int64(*mismatchScore), int64(*gapScore)},
+		minimumAlignmentScore:         int64(*minimumAlignmentScore),
+		minimumIdentity:               *minimumIdentity,
+		includeDiff:                   *includeDiff,
+		fuzzyMatching:                 *fuzzyMatching,
+		equivalenceFile:               *equivalenceFile,
+		equivalentMatchWeight:         *equivalentMatchWeight,
+		paraphraseThreshold:           *paraphraseThreshold,
+		bilingualDictionary:           *bilingualDictionary,
+		matchingMode:                  *matchingMode,
+		reorderTolerance:              int64(*reorderTolerance),
+		compositeDistance:             int64(*compositeDistance),
+		manyToMany:                    *manyToMany,
+		selfAlignment:                 *selfAlignment,
+		selfAlignmentMinDistance:      int64(*selfAlignmentMinDistance),
+		significance:                  *significance,
+		maxPValue:                     *maxPValue,
+		minimumSignificance:           *minimumSignificance,
+		idfScoring:                    *idfScoring,
+		rareNgramRatio:                *rareNgramRatio,
+		minimumIDFScore:               *minimumIDFScore,
+		minimumNormalizedIDFScore:     *minimumNormalizedIDFScore,
+		minimumRareAnchors:            int64(*minimumRareAnchors),
+		explainBanality:               *explainBanality,
+		commonNgramsSelection:         *commonNgramsSelection,
+		mostCommonNgramThreshold:      *mostCommonNgramThreshold,
+		commonNgramsPercentile:        *commonNgramsPercentile,
+		commonNgramsDFRatio:           *commonNgramsDFRatio,
+		ngramIndexLocations:           []string{*ngramIndexLocation, *targetNgramIndexLocation},
+		formulaMode:                   *formulaMode,
+		formulaLimit:                  *formulaLimit,
+		calibrate:                     *calibrate,
+		calibrationPairs:              *calibrationPairs,
+		targetErrorRate:               *targetErrorRate,
+		calibrationSeed:               int64(*calibrationSeed),
+		sourceEncoding:                *sourceEncoding,
+		targetEncoding:                *targetEncoding,
+		debug:                         debug,
+	}
+	checkErr(checkContextMode(config.contextMode), "parseFlags")
+	checkErr(checkMatchingMode(config.matchingMode), "parseFlags")
+	checkErr(checkCalibrationMode(config.calibrate), "parseFlags")
+	checkErr(checkFormulaMode(config.formulaMode), "parseFlags")
+	checkErr(checkCommonNgramSelection(config.commonNgramsSelection), "parseFlags")
+	if config.maxPValue > 0 || config.minimumSignificance > 0 {
+		config.significance = true
+		if config.minimumMatchingNgrams != int64(*significanceMinimumNgrams) { // significance replaces the fixed threshold
+			fmt.Printf("Significance filtering replaces minimum_matching_ngrams=%d with significance_minimum_matching_ngrams=%d.\n", config.minimumMatchingNgrams, *significanceMinimumNgrams)
+			config.minimumMatchingNgrams = int64(*significanceMinimumNgrams)
+		}
+	}
+	if config.minimumIDFScore > 0 || config.minimumNormalizedIDFScore > 0 {
+		config.idfScoring = true
+	}
+	if config.bilingualDictionary != "" && config.matchingMode != "unordered" {
+		fmt.Println("Cross-language alignment uses unordered matching since translations rarely follow the word order of their source.")
+		config.matchingMode = "unordered"
+	}
+	for _, encoding := range []string{config.sourceEncoding, config.targetEncoding} {
+		_, err := getRuneDecoder(encoding)
+		checkErr(err, "parseFlags")
+	}
+	ngramIndex := make(map[int64]string)
+	if (config.debug || config.explainBanality) && *ngramIndexLocation != "" {
 		ngramIndex = loadNgramIndex(*ngramIndexLocation)
 	} else {
-		ngramIndex = map[int32]string{}
+		ngramIndex = map[int64]string{}
 	}
 	fmt.Printf("Loading metadata...")
 	if *sourceMetadataArg == "" {
@@ -210,6 +476,39 @@ func parseFlags() ([]sortedFile, []sortedFile, map[string]map[string]string, map
 		os.Exit(-1)
 	}
 	mostCommonNgrams := compileMostCommonNgrams(sourceCommonNgramsArg, targetCommonNgramsArg, mostCommonNgramThreshold)
+	if config.fuzzyMatching || config.equivalenceFile != "" {
+		if *ngramIndexLocation == "" {
+			fmt.Println("\nFuzzy and equivalence matching require the --ngram_index option, stopping now...")
+			os.Exit(-1)
+		}
+		fuzzyNgrams = newFuzzyIndex(*ngramIndexLocation, *targetNgramIndexLocation, variantOptions{config.fuzzyMatching, *fuzzyMaxDistance, *fuzzyMinTokenLength, config.equivalenceFile})
+		fuzzyNgrams.rekeyCommonNgrams(mostCommonNgrams)
+	}
+	if config.bilingualDictionary != "" {
+		if len(targetFiles) == 0 || *ngramIndexLocation == "" || *targetNgramIndexLocation == "" {
+			fmt.Println("\nCross-language alignment requires target files along with the --ngram_index and --target_ngram_index options, stopping now...")
+			os.Exit(-1)
+		}
+		if fuzzyNgrams != nil {
+			fmt.Println("\nCross-language alignment cannot be combined with fuzzy or equivalence matching, stopping now...")
+			os.Exit(-1)
+		}
+		translations = newTranslationIndex(*ngramIndexLocation, *targetNgramIndexLocation, config.bilingualDictionary)
+		translations.rekeyCommonNgrams(mostCommonNgrams)
+	}
+	formulaLists = loadFormulaLists(*knownFormulaeLists)
+	knownFormulae = make(map[int64]bool)
+	for _, list := range formulaLists {
+		if fuzzyNgrams != nil {
+			fuzzyNgrams.rekeyCommonNgrams(list.ngrams)
+		}
+		if translations != nil {
+			translations.rekeyCommonNgrams(list.ngrams)
+		}
+		for ngram := range list.ngrams {
+			knownFormulae[ngram] = true
+		}
+	}
 	return sourceFiles, targetFiles, sourceMetadata, targetMetadata, mostCommonNgrams, config, ngramIndex
 }
 
@@ -324,9 +623,8 @@ func getJSONDocs(fileLocations []sortedFile, prefixString string, threads int) [
 				defer wait.Done()
 				jsonFile, err := ioutil.ReadFile(fileLocation.docID)
 				checkErr(err, "getJSONDocs")
-				tempDoc := make(map[int32][][]int32)
-				json.Unmarshal(jsonFile, &tempDoc)
-				doc := make(map[int32][]indexedNgram)
+				tempDoc, header := parseIndexFile(jsonFile)
+				doc := make(map[int64][]indexedNgram)
 				for key, value := range tempDoc {
 					doc[key] = []indexedNgram{}
 					for _, ngram := range value {
@@ -334,7 +632,10 @@ func getJSONDocs(fileLocations []sortedFile, prefixString string, threads int) [
 					}
 				}
 				docID := path.Base(strings.Replace(fileLocation.docID, ".json", "", 1))
-				docObject := docIndex{docID, doc, len(doc), fileLocation.sortID}
+				docObject := docIndex{docID, doc, len(doc), fileLocation.sortID, header.HashWidth, nil, nil}
+				if fuzzyNgrams != nil {
+					fuzzyNgrams.rekey(&docObject)
+				}
 				c <- docObject
 			}(fileLocation)
 		}
@@ -353,11 +654,36 @@ func getJSONDocs(fileLocations []sortedFile, prefixString string, threads int) [
 	sort.Slice(jsonFiles, func(i, j int) bool {
 		return jsonFiles[i].SortID < jsonFiles[j].SortID
 	})
+	for _, doc := range jsonFiles {
+		if doc.HashWidth != jsonFiles[0].HashWidth {
+			fmt.Printf("\nNgram indexes mix %d-bit and %d-bit hashes: regenerate ngrams with a single hash width. Stopping now...\n", jsonFiles[0].HashWidth, doc.HashWidth)
+			os.Exit(-1)
+		}
+	}
 	return jsonFiles
 }
 
-func compileMostCommonNgrams(sourceNgrams *string, targetNgrams *string, mostCommonNgramThreshold *int) map[int32]bool {
-	uniqueNgrams := make(map[int32]bool)
+// parseIndexFile reads either a headed index file or a legacy one which only contains ngrams
+func parseIndexFile(jsonFile []byte) (map[int64][][]int64, indexHeader) {
+	if bytes.HasPrefix(bytes.TrimSpace(jsonFile), []byte(`{"header"`)) {
+		indexFile := headedIndexFile{}
+		err := json.Unmarshal(jsonFile, &indexFile)
+		checkErr(err, "parseIndexFile")
+		if indexFile.Header.HashWidth != 32 && indexFile.Header.HashWidth != 64 {
+			checkErr(fmt.Errorf("unsupported ngram hash width: %d", indexFile.Header.HashWidth), "parseIndexFile")
+		}
+		if indexFile.Header.OffsetWidth != 32 && indexFile.Header.OffsetWidth != 64 {
+			checkErr(fmt.Errorf("unsupported byte offset width: %d", indexFile.Header.OffsetWidth), "parseIndexFile")
+		}
+		return indexFile.Ngrams, indexFile.Header
+	}
+	tempDoc := make(map[int64][][]int64)
+	json.Unmarshal(jsonFile, &tempDoc)
+	return tempDoc, indexHeader{32, 32}
+}
+
+func compileMostCommonNgrams(sourceNgrams *string, targetNgrams *string, mostCommonNgramThreshold *int) map[int64]bool {
+	uniqueNgrams := make(map[int64]bool)
 	listOfFiles := []string{*sourceNgrams, *targetNgrams}
 	for _, filename := range listOfFiles {
 		if filename == "" {
@@ -374,19 +700,19 @@ func compileMostCommonNgrams(sourceNgrams *string, targetNgrams *string, mostCom
 				break
 			}
 			line = strings.TrimSpace(line)
-			intNgram, _ := strconv.Atoi(line)
-			uniqueNgrams[int32(intNgram)] = true
+			intNgram, _ := strconv.ParseInt(line, 10, 64)
+			uniqueNgrams[intNgram] = true
 		}
 	}
 	return uniqueNgrams
 }
 
-func loadNgramIndex(fileLocation string) map[int32]string {
+func loadNgramIndex(fileLocation string) map[int64]string {
 	file, err := os.Open(fileLocation)
 	defer file.Close()
 	checkErr(err, "loadNgramIndex")
 	reader := bufio.NewReader(file)
-	ngramIndex := make(map[int32]string)
+	ngramIndex := make(map[int64]string)
 	var line string
 	for {
 		line, err = reader.ReadString('\n')
@@ -396,14 +722,14 @@ func loadNgramIndex(fileLocation string) map[int32]string {
 		line = strings.TrimSpace(line)
 		values := strings.Split(line, "\t")
 		if len(values) == 2 { // avoid dying on empty line
-			intValue, _ := strconv.Atoi(values[1])
-			ngramIndex[int32(intValue)] = values[0]
+			intValue, _ := strconv.ParseInt(values[1], 10, 64)
+			ngramIndex[intValue] = values[0]
 		}
 	}
 	return ngramIndex
 }
 
-func alignPassages(sourceFiles []sortedFile, targetFiles []sortedFile, sourceMetadata map[string]map[string]string, targetMetadata map[string]map[string]string, commonNgrams map[int32]bool, config *matchingParams, ngramIndex map[int32]string) int {
+func alignPassages(sourceFiles []sortedFile, targetFiles []sortedFile, sourceMetadata map[string]map[string]string, targetMetadata map[string]map[string]string, commonNgrams map[int64]bool, config *matchingParams, ngramIndex map[int64]string) int {
 	sourceAgainstSource := false
 
 	// Split source and target files into config.batchSize batches
@@ -425,6 +751,7 @@ func alignPassages(sourceFiles []sortedFile, targetFiles []sortedFile, sourceMet
 	}
 	mergedOutput := createOutputFile(config)
 	duplicateFilesOutput := creatDuplicateFilesOutputFile(config)
+	compositeOutput := createCompositeOutputFile(config)
 	counts := 0
 	for sourceBatchNumber := 0; sourceBatchNumber < config.sourceBatch; sourceBatchNumber++ {
 		prefixString := "Loading source files"
@@ -433,6 +760,9 @@ func alignPassages(sourceFiles []sortedFile, targetFiles []sortedFile, sourceMet
 			fmt.Printf("\n### Comparing source batch %d against all... ###\n", sourceBatchNumber+1)
 		}
 		sourceFileIndexes := getJSONDocs(sourceFileBatches[sourceBatchNumber], prefixString, config.numThreads)
+		if translations != nil {
+			translations.rekeySourceDocs(sourceFileIndexes)
+		}
 		for targetBatchNumber := 0; targetBatchNumber < config.targetBatch; targetBatchNumber++ {
 			if sourceAgainstSource && sourceBatchNumber > targetBatchNumber {
 				continue // we've already done these comparisons in the other direction
@@ -446,10 +776,22 @@ func alignPassages(sourceFiles []sortedFile, targetFiles []sortedFile, sourceMet
 					targetPrefix += fmt.Sprintf(" from target batch %d", targetBatchNumber+1)
 				}
 				targetFileIndexes = getJSONDocs(targetFileBatches[targetBatchNumber], targetPrefix, config.numThreads)
+				if translations != nil {
+					translations.rekeyTargetDocs(targetFileIndexes)
+				}
+				if len(sourceFileIndexes) > 0 && len(targetFileIndexes) > 0 && sourceFileIndexes[0].HashWidth != targetFileIndexes[0].HashWidth {
+					fmt.Printf("Source ngrams use %d-bit hashes while target ngrams use %d-bit hashes: they cannot be compared. Stopping now...\n", sourceFileIndexes[0].HashWidth, targetFileIndexes[0].HashWidth)
+					os.Exit(-1)
+				}
 			}
 			percentSteps := buildPercentMap(len(sourceFileIndexes))
 			fmt.Printf("Comparing files... 0%%")
 			for pos, sourceFile := range sourceFileIndexes {
+				sourcePositions := ngramsByPosition(&sourceFile)
+				var sourceOffsets []indexedNgram
+				if config.refineBoundaries {
+					sourceOffsets = ngramOffsets(&sourceFile)
+				}
 				if config.debug {
 					if config.sourceBatch == 1 {
 						fmt.Printf("Comparing source file %s to all...\n", sourceFile.DocID)
@@ -469,6 +811,9 @@ func alignPassages(sourceFiles []sortedFile, targetFiles []sortedFile, sourceMet
 				var start int
 				if sourceAgainstSource && sourceBatchNumber == targetBatchNumber {
 					start = pos + 1
+					if config.selfAlignment {
+						start = pos // the source file is also compared with itself
+					}
 				} else {
 					start = 0
 				}
@@ -500,11 +845,12 @@ func alignPassages(sourceFiles []sortedFile, targetFiles []sortedFile, sourceMet
 					totalTexts += len(splitTargets)
 					start = end
 					end += increment
-					go func(splitTargets []docIndex, sourceAgainstSource bool, sourceMetadata map[string]map[string]string, targetMetadata map[string]map[string]string, config *matchingParams, commonNgrams map[int32]bool) {
+					go func(splitTargets []docIndex, sourceAgainstSource bool, sourceMetadata map[string]map[string]string, targetMetadata map[string]map[string]string, config *matchingParams, commonNgrams map[int64]bool) {
 						defer wait.Done()
 						localAlignments := []alignmentsPerDoc{}
 						for _, targetFile := range splitTargets {
-							if sourceAgainstSource && sourceFile.SortID >= targetFile.SortID {
+							selfAlignment := config.selfAlignment && sourceAgainstSource && sourceFile.DocID == targetFile.DocID
+							if sourceAgainstSource && sourceFile.SortID >= targetFile.SortID && !selfAlignment {
 								continue
 							}
 							var debugOutput *os.File
@@ -514,32 +860,63 @@ func alignPassages(sourceFiles []sortedFile, targetFiles []sortedFile, sourceMet
 							sourceTargetIntersection, totalCommonNgrams := getIntersection(&sourceFile, &targetFile)
 							if len(sourceTargetIntersection) < config.minimumMatchingNgramsInDocs {
 								continue
-							} else if float64(totalCommonNgrams)/float64(sourceFile.NgramLength)*100 > config.duplicateThreshold {
+							} else if !selfAlignment && float64(totalCommonNgrams)/float64(sourceFile.NgramLength)*100 > config.duplicateThreshold {
 								sourceInfo := fmt.Sprintf("%s (%s) [%s]", sourceMetadata[sourceFile.DocID]["title"], sourceMetadata[sourceFile.DocID]["author"], sourceMetadata[sourceFile.DocID]["filename"])
 								targetInfo := fmt.Sprintf("%s (%s) [%s]", targetMetadata[targetFile.DocID]["title"], targetMetadata[targetFile.DocID]["author"], targetMetadata[targetFile.DocID]["filename"])
 								localAlignments = append(localAlignments, alignmentsPerDoc{targetFile.DocID, []Alignment{}, []string{sourceInfo, targetInfo}})
 								continue
 							}
-							mostCommonNgrams := getMostCommonNgrams(sourceTargetIntersection, &config.banalNgrams, commonNgrams)
-							var matches = []ngramMatch{}
-							for ngram := range sourceTargetIntersection {
-								for _, sourceNgramIndex := range sourceFile.Ngrams[ngram] {
-									for _, targetNgramIndex := range targetFile.Ngrams[ngram] {
-										matches = append(matches, ngramMatch{sourceNgramIndex, targetNgramIndex, ngram})
-									}
+							banalNgrams := getMostCommonNgrams(sourceTargetIntersection, &config.banalNgrams, commonNgrams)
+							matches := getMatches(&sourceFile, &targetFile, sourceTargetIntersection)
+							if selfAlignment {
+								matches = selfMatches(matches, config.selfAlignmentMinDistance)
+							}
+							var targetOffsets []indexedNgram
+							if config.refineBoundaries {
+								targetOffsets = ngramOffsets(&targetFile)
+							}
+							match := func(matches []ngramMatch) []Alignment {
+								var alignments []Alignment
+								if config.matchingMode == "unordered" {
+									alignments = matchPassageUnordered(matches, config)
+								} else {
+									alignments = matchPassage(&sourceFile, &targetFile, matches, config, ngramIndex, debugOutput)
+								}
+								if config.refineBoundaries {
+									refineBoundaries(alignments, sourceOffsets, targetOffsets, sourceMetadata[sourceFile.DocID]["filename"], targetMetadata[targetFile.DocID]["filename"], config)
+								}
+								if config.mergeOnByteDistance || config.mergeOnNgramDistance {
+									alignments = mergeWithPrevious(alignments, config, debugOutput)
 								}
+								return alignments
+							}
+							var alignments []Alignment
+							if config.manyToMany {
+								alignments = matchAllOccurrences(matches, match) // passages are merged within each occurrence
+							} else {
+								alignments = match(matches)
+							}
+							if selfAlignment {
+								alignments = dropSelfOverlaps(alignments)
 							}
-							sort.Slice(matches, func(i, j int) bool {
-								if matches[i].source.index < matches[j].source.index {
-									return true
-								} else if matches[i].source.index > matches[j].source.index {
-									return false
+							if config.verifyAlignments {
+								alignments = verifyAlignments(alignments, sourceMetadata[sourceFile.DocID]["filename"], targetMetadata[targetFile.DocID]["filename"], config)
+							}
+							if len(alignments) > 0 {
+								targetPositions := ngramsByPosition(&targetFile)
+								alignments = scoreBanality(alignments, &sourceFile, sourcePositions, targetPositions, banalNgrams, ngramIndex, config)
+								if config.significance {
+									alignments = scoreSignificance(alignments, sourcePositions, config)
+								}
+								if config.idfScoring {
+									alignments = scoreInformativeness(alignments, sourcePositions, targetPositions, config)
 								}
-								return matches[i].target.index < matches[j].target.index
-							})
-							alignments := matchPassage(&sourceFile, &targetFile, matches, config, mostCommonNgrams, ngramIndex, debugOutput)
-							if config.mergeOnByteDistance || config.mergeOnNgramDistance {
-								alignments = mergeWithPrevious(alignments, config, debugOutput)
+							}
+							if config.manyToMany {
+								countOccurrences(alignments)
+							}
+							if config.compositeDistance > 0 {
+								detectComposites(alignments, config.compositeDistance)
 							}
 							if len(alignments) > 0 {
 								localAlignments = append(localAlignments, alignmentsPerDoc{targetFile.DocID, alignments, []string{}})
@@ -558,7 +935,7 @@ func alignPassages(sourceFiles []sortedFile, targetFiles []sortedFile, sourceMet
 					}
 				}
 				if len(combinedAlignments.alignments) > 0 {
-					writeAligments(combinedAlignments, &sourceFile.DocID, sourceMetadata, targetMetadata, mergedOutput, duplicateFilesOutput, config, &counts)
+					writeAligments(combinedAlignments, &sourceFile.DocID, sourceMetadata, targetMetadata, mergedOutput, duplicateFilesOutput, compositeOutput, config, &counts)
 				}
 			}
 			os.Stdout.Write([]byte("\r\033[KComparing files... done.\n"))
@@ -567,12 +944,17 @@ func alignPassages(sourceFiles []sortedFile, targetFiles []sortedFile, sourceMet
 	}
 	mergedOutput.Sync()
 	mergedOutput.Close()
+	if compositeOutput != nil {
+		compositeOutput.file.Sync()
+		compositeOutput.file.Close()
+		fmt.Printf("%d composite borrowings found...\n", compositeOutput.counts)
+	}
 	fmt.Printf("%d pairwise alignments found...\n", counts)
 	return counts
 }
 
-func getIntersection(sourceFile *docIndex, targetFile *docIndex) (map[int32]int, int) {
-	intersectCount := make(map[int32]int)
+func getIntersection(sourceFile *docIndex, targetFile *docIndex) (map[int64]int, int) {
+	intersectCount := make(map[int64]int)
 	totalCommonNgrams := 0
 	if sourceFile.NgramLength < targetFile.NgramLength {
 		for ngram := range sourceFile.Ngrams {
@@ -592,22 +974,49 @@ func getIntersection(sourceFile *docIndex, targetFile *docIndex) (map[int32]int,
 	return intersectCount, totalCommonNgrams
 }
 
-func getMostCommonNgrams(intersectionCount map[int32]int, banalNgrams *int, commonNgrams map[int32]bool) map[int32]bool {
+// getMatches lists all pairs of source and target occurrences of common ngrams, sorted by source then target index
+func getMatches(sourceFile *docIndex, targetFile *docIndex, intersection map[int64]int) []ngramMatch {
+	var matches = []ngramMatch{}
+	for ngram := range intersection {
+		for _, sourceNgramIndex := range sourceFile.Ngrams[ngram] {
+			for _, targetNgramIndex := range targetFile.Ngrams[ngram] {
+				fuzzy, equivalent := matchVariants(sourceFile, targetFile, sourceNgramIndex, targetNgramIndex)
+				matches = append(matches, ngramMatch{sourceNgramIndex, targetNgramIndex, ngram, fuzzy, equivalent, isTranslatedMatch(sourceFile, sourceNgramIndex)})
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].source.index < matches[j].source.index {
+			return true
+		} else if matches[i].source.index > matches[j].source.index {
+			return false
+		}
+		return matches[i].target.index < matches[j].target.index
+	})
+	return matches
+}
+
+// getMostCommonNgrams combines the most frequent ngrams shared by a document pair with the most common ngrams
+// of the corpus and known formulae, keeping track of the sources of banality of each ngram
+func getMostCommonNgrams(intersectionCount map[int64]int, banalNgrams *int, commonNgrams map[int64]bool) map[int64]uint8 {
 	sortedIntersection := sortMapByValue(intersectionCount)
-	mostCommonNgrams := make(map[int32]bool, len(commonNgrams))
+	mostCommonNgrams := make(map[int64]uint8, len(commonNgrams)+len(knownFormulae))
 	var count int
 	for _, pair := range sortedIntersection {
 		if pair.Value == 2 {
 			break
 		}
-		mostCommonNgrams[pair.Key] = true
+		mostCommonNgrams[pair.Key] |= pairCommonNgram
 		count++
 		if count == *banalNgrams {
 			break
 		}
 	}
-	for commonNgrams := range commonNgrams {
-		mostCommonNgrams[commonNgrams] = true
+	for commonNgram := range commonNgrams {
+		mostCommonNgrams[commonNgram] |= corpusCommonNgram
+	}
+	for formulaNgram := range knownFormulae {
+		mostCommonNgrams[formulaNgram] |= knownFormulaNgram
 	}
 	return mostCommonNgrams
 }
@@ -636,6 +1045,57 @@ func createOutputFile(config *matchingParams) *os.File {
 		"outputPath",
 		"numThreads",
 		"sortingField",
+		"contextMode",
+		"language",
+		"textCacheSize",
+		"excludedElements",
+		"excludedPlaceholder",
+		"citations",
+		"sourcePhiloWords",
+		"targetPhiloWords",
+		"sourcePhiloDBLink",
+		"targetPhiloDBLink",
+		"philoLinkTemplate",
+		"rollupLevels",
+		"refineBoundaries",
+		"refinementWindow",
+		"verifyAlignments",
+		"localAlignmentScores",
+		"minimumAlignmentScore",
+		"minimumIdentity",
+		"includeDiff",
+		"fuzzyMatching",
+		"equivalenceFile",
+		"equivalentMatchWeight",
+		"paraphraseThreshold",
+		"bilingualDictionary",
+		"matchingMode",
+		"reorderTolerance",
+		"compositeDistance",
+		"manyToMany",
+		"selfAlignment",
+		"selfAlignmentMinDistance",
+		"significance",
+		"maxPValue",
+		"minimumSignificance",
+		"idfScoring",
+		"rareNgramRatio",
+		"minimumIDFScore",
+		"minimumNormalizedIDFScore",
+		"minimumRareAnchors",
+		"explainBanality",
+		"commonNgramsSelection",
+		"mostCommonNgramThreshold",
+		"commonNgramsPercentile",
+		"commonNgramsDFRatio",
+		"formulaMode",
+		"formulaLimit",
+		"calibrate",
+		"calibrationPairs",
+		"targetErrorRate",
+		"calibrationSeed",
+		"sourceEncoding",
+		"targetEncoding",
 		"debug",
 	}
 	v := reflect.ValueOf(*config)
@@ -652,7 +1112,7 @@ func createOutputFile(config *matchingParams) *os.File {
 }
 
 func createDebugOutputFile(config *matchingParams, sourceDocID string, targetDocID string) *os.File {
-	debugOutputPath := fmt.Sprintf(filepath.Join(config.outputPath, "debug_output"))
+	debugOutputPath := filepath.Join(config.outputPath, "debug_output")
 	if _, err := os.Stat(debugOutputPath); os.IsNotExist(err) {
 		os.MkdirAll(debugOutputPath, 0755)
 	}
@@ -663,13 +1123,13 @@ func createDebugOutputFile(config *matchingParams, sourceDocID string, targetDoc
 }
 
 func creatDuplicateFilesOutputFile(config *matchingParams) *os.File {
-	duplicateFiles, err := os.Create(fmt.Sprintf(filepath.Join(config.outputPath, "duplicate_files.txt")))
+	duplicateFiles, err := os.Create(filepath.Join(config.outputPath, "duplicate_files.txt"))
 	checkErr(err, "creatDuplicateFilesOutputFile")
 	duplicateFiles.WriteString("## Duplicates of source files in target files\n")
 	return duplicateFiles
 }
 
-func matchPassage(sourceFile *docIndex, targetFile *docIndex, matches []ngramMatch, config *matchingParams, mostCommonNgrams map[int32]bool, ngramIndex map[int32]string, debugOutput *os.File) []Alignment {
+func matchPassage(sourceFile *docIndex, targetFile *docIndex, matches []ngramMatch, config *matchingParams, ngramIndex map[int64]string, debugOutput *os.File) []Alignment {
 	alignments := make([]Alignment, 0)
 	m := &matchValues{}
 	m.lastSourcePosition = 0
@@ -691,10 +1151,21 @@ func matchPassage(sourceFile *docIndex, targetFile *docIndex, matches []ngramMat
 		m.firstMatch = []indexedNgram{currentAnchor.source, currentAnchor.target}
 		m.matchesInCurrentAlignment = 1
 		m.matchesInCurrentWindow = 1
-		m.commonNgramMatches = 0
-		if _, ok := mostCommonNgrams[currentAnchor.ngram]; ok {
-			m.commonNgramMatches++
+		m.fuzzyMatches = 0
+		if currentAnchor.fuzzy {
+			m.fuzzyMatches++
+		}
+		m.equivalentMatches = 0
+		if currentAnchor.equivalent {
+			m.equivalentMatches++
 		}
+		m.translatedMatches = 0
+		if currentAnchor.translated {
+			m.translatedMatches++
+		}
+		m.rareAnchors = 0
+		m.rareAnchorsInCurrentWindow = 0
+		countRareAnchor(m, &currentAnchor, config)
 		m.lastMatch = []indexedNgram{currentAnchor.source, currentAnchor.target}
 		if config.debug {
 			m.debug = []string{ngramIndex[currentAnchor.ngram]}
@@ -722,7 +1193,7 @@ func matchPassage(sourceFile *docIndex, targetFile *docIndex, matches []ngramMat
 				m.inAlignment = false
 			}
 			if source.index > m.sourceWindowBoundary || target.index > m.targetWindowBoundary {
-				if m.matchesInCurrentWindow < config.minimumMatchingNgramsInWindow {
+				if m.matchesInCurrentWindow < config.minimumMatchingNgramsInWindow || !windowHasRareAnchors(m, config) {
 					m.inAlignment = false
 				} else {
 					if source.index > m.maxSourceGap || target.index > m.maxTargetGap {
@@ -733,11 +1204,12 @@ func matchPassage(sourceFile *docIndex, targetFile *docIndex, matches []ngramMat
 						m.targetAnchor = target.index
 						m.targetWindowBoundary = m.targetAnchor + matchingWindowSize
 						m.matchesInCurrentWindow = 0
+						m.rareAnchorsInCurrentWindow = 0
 					}
 				}
 			}
 			if !m.inAlignment {
-				if m.matchesInCurrentAlignment >= config.minimumMatchingNgrams {
+				if weightedMatches(m, config) >= float64(config.minimumMatchingNgrams) && hasRareAnchors(m, config) {
 					addAlignment(m, config, &alignments)
 					if config.debug {
 						writeDebugOutput(m, true, &currentAnchor, debugOutput)
@@ -767,14 +1239,21 @@ func matchPassage(sourceFile *docIndex, targetFile *docIndex, matches []ngramMat
 				}
 			}
 			m.lastMatch = []indexedNgram{source, target} // save last matching ngrams
-			if _, ok := mostCommonNgrams[match.ngram]; ok {
-				m.commonNgramMatches++
+			if match.fuzzy {
+				m.fuzzyMatches++
+			}
+			if match.equivalent {
+				m.equivalentMatches++
+			}
+			if match.translated {
+				m.translatedMatches++
 			}
+			countRareAnchor(m, &match, config)
 			if config.debug {
 				m.debug = append(m.debug, ngramIndex[match.ngram])
 			}
 		}
-		if m.inAlignment && m.matchesInCurrentAlignment >= config.minimumMatchingNgrams {
+		if m.inAlignment && weightedMatches(m, config) >= float64(config.minimumMatchingNgrams) && hasRareAnchors(m, config) {
 			addAlignment(m, config, &alignments)
 		}
 	}
@@ -783,8 +1262,8 @@ func matchPassage(sourceFile *docIndex, targetFile *docIndex, matches []ngramMat
 
 // Merge alignments based on either byte distance or ngram distance
 func mergeWithPrevious(alignments []Alignment, config *matchingParams, debugOutput *os.File) []Alignment {
-	var maxSourceDistance, maxTargetDistance int32
-	var maxNgramDistance int32
+	var maxSourceDistance, maxTargetDistance int64
+	var maxNgramDistance int64
 	maxSourceDistance = 0
 	maxTargetDistance = 0
 	if config.mergeOnNgramDistance {
@@ -802,7 +1281,7 @@ func mergeWithPrevious(alignments []Alignment, config *matchingParams, debugOutp
 		}
 		currentAlignmentMerged := false
 		if config.mergeOnByteDistance {
-			distanceValue := int32(math.Floor((float64(previousAlignment.source.endByte - previousAlignment.source.startByte)) * config.passageDistanceMultiplier))
+			distanceValue := int64(math.Floor((float64(previousAlignment.source.endByte - previousAlignment.source.startByte)) * config.passageDistanceMultiplier))
 			maxSourceDistance = previousAlignment.source.endByte + distanceValue
 			maxTargetDistance = previousAlignment.target.endByte + distanceValue
 		}
@@ -813,16 +1292,12 @@ func mergeWithPrevious(alignments []Alignment, config *matchingParams, debugOutp
 			currentAlignment.target.startByte <= maxTargetDistance &&
 			currentAlignment.target.startByte > previousAlignment.target.endByte {
 			currentAlignmentMerged = true
-			sourcePosition := position{previousAlignment.source.startByte, currentAlignment.source.endByte, previousAlignment.source.startNgramIndex, currentAlignment.source.endNgramIndex}
-			targetPosition := position{previousAlignment.target.startByte, currentAlignment.target.endByte, previousAlignment.target.startNgramIndex, currentAlignment.target.endNgramIndex}
-			previousAlignment = Alignment{sourcePosition, targetPosition, previousAlignment.totalMatchingNgrams + currentAlignment.totalMatchingNgrams, false} // we consider merged passages as non-banality
+			previousAlignment = mergeAlignmentPair(&previousAlignment, &currentAlignment)
 		} else if currentAlignment.source.startNgramIndex <= sourceNgramDistance &&
 			currentAlignment.target.startNgramIndex <= targetNgramDistance &&
 			currentAlignment.target.startNgramIndex > previousAlignment.target.endNgramIndex {
 			currentAlignmentMerged = true
-			sourcePosition := position{previousAlignment.source.startByte, currentAlignment.source.endByte, previousAlignment.source.startNgramIndex, currentAlignment.source.endNgramIndex}
-			targetPosition := position{previousAlignment.target.startByte, currentAlignment.target.endByte, previousAlignment.target.startNgramIndex, currentAlignment.target.endNgramIndex}
-			previousAlignment = Alignment{sourcePosition, targetPosition, previousAlignment.totalMatchingNgrams + currentAlignment.totalMatchingNgrams, false} // we consider merged passages as non-banality
+			previousAlignment = mergeAlignmentPair(&previousAlignment, &currentAlignment)
 		} else {
 			mergedAlignments = append(mergedAlignments, previousAlignment) // we store previous since it can no longer be merged with next
 			previousAlignment = currentAlignment                           // current match was not merged with previous so now becomes previous
@@ -869,7 +1344,7 @@ func writeDebugOutput(m *matchValues, match bool, currentAnchor *ngramMatch, deb
 }
 
 func writeAligments(combinedAlignments *CombinedAlignments, sourceDocID *string, sourceMetadata map[string]map[string]string,
-	targetMetadata map[string]map[string]string, f *os.File, duplicatesFile *os.File, config *matchingParams, counts *int) {
+	targetMetadata map[string]map[string]string, f *os.File, duplicatesFile *os.File, composites *compositeWriter, config *matchingParams, counts *int) {
 	for _, alignments := range combinedAlignments.alignments {
 		fullAlignment := map[string]string{}
 		for key, value := range sourceMetadata[*sourceDocID] {
@@ -880,27 +1355,107 @@ func writeAligments(combinedAlignments *CombinedAlignments, sourceDocID *string,
 		}
 		fullAlignment["source_doc_id"] = *sourceDocID
 		fullAlignment["target_doc_id"] = alignments.docID
+		var compositeIDs map[int]string
+		compositeSegments := make(map[string][]compositeSegment)
+		if composites != nil {
+			compositeIDs = composites.compositeIDs(alignments.matches)
+		}
 		for _, alignment := range alignments.matches {
 			localAlignment := fullAlignment
 			localAlignment["source_start_byte"] = strconv.Itoa(int(alignment.source.startByte))
 			localAlignment["source_end_byte"] = strconv.Itoa(int(alignment.source.endByte))
-			sourcePassages := alignmentToText(&alignment.source, sourceMetadata[*sourceDocID]["filename"], config)
+			sourcePassages := alignmentToText(&alignment.source, sourceMetadata[*sourceDocID]["filename"], config.sourceEncoding, config)
 			localAlignment["source_context_before"] = sourcePassages[0]
 			localAlignment["source_passage"] = sourcePassages[1]
 			localAlignment["source_context_after"] = sourcePassages[2]
+			if config.citations {
+				addCitationFields(localAlignment, "source_", documentTexts.get(sourceMetadata[*sourceDocID]["filename"], config.sourceEncoding), &alignment.source)
+			}
+			if philoDocuments != nil {
+				addPhiloFields(localAlignment, "source_", philoDocuments.get(philoDocuments.sourceWordsDir, *sourceDocID), &alignment.source, config.philoLinkTemplate, config.sourcePhiloDBLink)
+			}
 			localAlignment["target_start_byte"] = strconv.Itoa(int(alignment.target.startByte))
 			localAlignment["target_end_byte"] = strconv.Itoa(int(alignment.target.endByte))
-			targetPassages := alignmentToText(&alignment.target, targetMetadata[alignments.docID]["filename"], config)
+			targetPassages := alignmentToText(&alignment.target, targetMetadata[alignments.docID]["filename"], config.targetEncoding, config)
 			localAlignment["target_context_before"] = targetPassages[0]
 			localAlignment["target_passage"] = targetPassages[1]
 			localAlignment["target_context_after"] = targetPassages[2]
+			if config.citations {
+				addCitationFields(localAlignment, "target_", documentTexts.get(targetMetadata[alignments.docID]["filename"], config.targetEncoding), &alignment.target)
+			}
+			if philoDocuments != nil {
+				addPhiloFields(localAlignment, "target_", philoDocuments.get(philoDocuments.targetWordsDir, alignments.docID), &alignment.target, config.philoLinkTemplate, config.targetPhiloDBLink)
+			}
 			localAlignment["banality"] = fmt.Sprintf("%v", alignment.banality)
+			localAlignment["banality_score"] = strconv.FormatFloat(alignment.banalityScore, 'f', 2, 64)
+			if config.explainBanality {
+				localAlignment["banal_ngrams"] = alignment.banalNgrams
+			}
+			if len(formulaLists) > 0 {
+				localAlignment["formulae"] = alignment.formulae
+			}
+			if config.verifyAlignments {
+				localAlignment["alignment_score"] = strconv.FormatInt(alignment.alignmentScore, 10)
+				localAlignment["identity"] = strconv.FormatFloat(alignment.identity, 'f', 2, 64)
+			}
+			if config.fuzzyMatching {
+				localAlignment["fuzzy_match"] = fmt.Sprintf("%v", alignment.fuzzyMatches > 0)
+				localAlignment["fuzzy_matching_ngrams"] = strconv.FormatInt(alignment.fuzzyMatches, 10)
+			}
+			if config.equivalenceFile != "" {
+				localAlignment["equivalent_matching_ngrams"] = strconv.FormatInt(alignment.equivalentMatches, 10)
+				localAlignment["borrowing_type"] = borrowingType(&alignment, config)
+			}
+			if config.bilingualDictionary != "" {
+				localAlignment["translation_match"] = fmt.Sprintf("%v", alignment.translatedMatches > 0)
+				localAlignment["translated_matching_ngrams"] = strconv.FormatInt(alignment.translatedMatches, 10)
+			}
+			if config.matchingMode == "unordered" {
+				localAlignment["reordered"] = fmt.Sprintf("%v", alignment.reordered)
+			}
+			if config.manyToMany {
+				localAlignment["source_passage_occurrences"] = strconv.Itoa(alignment.sourceOccurrences)
+				localAlignment["target_passage_occurrences"] = strconv.Itoa(alignment.targetOccurrences)
+			}
+			if config.selfAlignment {
+				localAlignment["self_alignment"] = fmt.Sprintf("%v", *sourceDocID == alignments.docID)
+			}
+			if config.significance {
+				localAlignment["p_value"] = strconv.FormatFloat(alignment.pValue, 'g', 4, 64)
+				localAlignment["significance_score"] = strconv.FormatFloat(alignment.significance, 'f', 2, 64)
+			}
+			if config.idfScoring {
+				localAlignment["idf_score"] = strconv.FormatFloat(alignment.idfScore, 'f', 2, 64)
+				localAlignment["rare_ngrams"] = strconv.FormatInt(alignment.rareNgrams, 10)
+				localAlignment["normalized_idf_score"] = strconv.FormatFloat(alignment.normalizedIDFScore, 'f', 3, 64)
+			}
+			if config.minimumRareAnchors > 0 {
+				localAlignment["rare_anchors"] = strconv.FormatInt(alignment.rareAnchors, 10)
+			}
+			if config.includeDiff {
+				localAlignment["passage_diff"] = passageDiff(&alignment.source, &alignment.target, sourceMetadata[*sourceDocID]["filename"], targetMetadata[alignments.docID]["filename"], config)
+			}
+			if config.refineBoundaries {
+				localAlignment["refined_boundaries"] = fmt.Sprintf("%v", alignment.refined)
+			}
 			*counts++
 			localAlignment["passage_id"] = strconv.Itoa(*counts)
+			if composites != nil {
+				compositeID := compositeIDs[alignment.compositeGroup]
+				localAlignment["composite_id"] = compositeID
+				if compositeID != "" {
+					compositeSegments[compositeID] = append(compositeSegments[compositeID], compositeSegment{PassageID: localAlignment["passage_id"],
+						SourceStartByte: alignment.source.startByte, SourceEndByte: alignment.source.endByte,
+						TargetStartByte: alignment.target.startByte, TargetEndByte: alignment.target.endByte})
+				}
+			}
 			jsonString, _ := json.Marshal(localAlignment)
 			jsonString = append(jsonString, "\n"...)
 			f.Write(jsonString)
 		}
+		if len(compositeSegments) > 0 {
+			composites.write(*sourceDocID, alignments.docID, compositeSegments)
+		}
 		if len(alignments.duplicates) > 0 {
 			duplicatesFile.WriteString(fmt.Sprintf("%s\n", strings.Join(alignments.duplicates, "\t")))
 		}
@@ -908,44 +1463,43 @@ func writeAligments(combinedAlignments *CombinedAlignments, sourceDocID *string,
 }
 
 // Returns three passages: the context before, the match itself, and the context after
-func alignmentToText(alignment *position, filename string, config *matchingParams) []string {
-	beforeContext := getText(&filename, alignment.startByte-int32(config.contextSize), alignment.startByte)
+func alignmentToText(alignment *position, filename string, encoding string, config *matchingParams) []string {
+	if config.contextMode != "bytes" {
+		doc := documentTexts.get(filename, encoding)
+		start, end := doc.cleanRange(alignment.startByte, alignment.endByte)
+		contextStart, contextEnd := doc.contextBounds(start, end, config.contextMode, int(config.contextSize), getSentenceRules(config.language))
+		return []string{doc.slice(contextStart, start), doc.slice(start, end), doc.slice(end, contextEnd)}
+	}
+	beforeContext := documentTexts.passage(filename, encoding, alignment.startByte-config.contextSize, alignment.startByte)
 	beforeContext = cleanStart.ReplaceAllString(beforeContext, "") // avoid truncation at beginning
-	matchingPassage := getText(&filename, alignment.startByte, alignment.endByte)
-	afterContext := getText(&filename, alignment.endByte, alignment.endByte+int32(config.contextSize))
+	matchingPassage := documentTexts.passage(filename, encoding, alignment.startByte, alignment.endByte)
+	afterContext := documentTexts.passage(filename, encoding, alignment.endByte, alignment.endByte+config.contextSize)
 	afterContext = cleanEnd.ReplaceAllString(afterContext, "") // avoid truncation at the end
 	passages := []string{beforeContext, matchingPassage, afterContext}
 	return passages
 }
 
-// Get text passages using file location and start and end byte
-func getText(fileLocation *string, startByte int32, endByte int32) string {
-	f, err := os.Open(*fileLocation)
-	checkErr(err, fmt.Sprintf("getText (opening %s)", *fileLocation))
-	if startByte < 0 {
-		startByte = int32(0)
-	}
-	_, err = f.Seek(int64(startByte), 0)
-	checkErr(err, "getText (seeking in file)")
-	passage := make([]byte, endByte-startByte)
-	_, err = f.Read(passage)
-	checkErr(err, "getText (reading in file)")
-	f.Close()
-	passage = bytes.Trim(passage, "\x00")
-	passage = bytes.Replace(passage, []byte("\xc2\xa0"), []byte(" "), -1) // remove non-breaking spaces
-	text := string(passage)
-	text = tags.ReplaceAllString(text, "")
-	text = brokenBeginTags.ReplaceAllString(text, "")
-	text = brokenEndTags.ReplaceAllString(text, "")
-	text = html.UnescapeString(text)
-	text = strings.Replace(text, "\\n", "\n", -1)
-	text = strings.Replace(text, "\\t", "\t", -1)
-	text = strings.Replace(text, "\\r", "\r", -1)
-	text = strings.Replace(text, "\t", " ", -1)
-	text = tabEntities.ReplaceAllString(text, " ")
-	text = strings.Replace(text, "\n", " ", -1)
-	text = spaces.ReplaceAllString(text, " ")
-	return text
+// Combine an alignment with the following one: the banality of merged passages is computed once passages are merged
+func mergeAlignmentPair(previousAlignment *Alignment, currentAlignment *Alignment) Alignment {
+	sourcePosition := position{previousAlignment.source.startByte, currentAlignment.source.endByte, previousAlignment.source.startNgramIndex, currentAlignment.source.endNgramIndex}
+	targetPosition := position{previousAlignment.target.startByte, currentAlignment.target.endByte, previousAlignment.target.startNgramIndex, currentAlignment.target.endNgramIndex}
+	return Alignment{
+		source:              sourcePosition,
+		target:              targetPosition,
+		totalMatchingNgrams: previousAlignment.totalMatchingNgrams + currentAlignment.totalMatchingNgrams,
+		refined:             previousAlignment.refined || currentAlignment.refined,
+		fuzzyMatches:        previousAlignment.fuzzyMatches + currentAlignment.fuzzyMatches,
+		equivalentMatches:   previousAlignment.equivalentMatches + currentAlignment.equivalentMatches,
+		translatedMatches:   previousAlignment.translatedMatches + currentAlignment.translatedMatches,
+		rareAnchors:         previousAlignment.rareAnchors + currentAlignment.rareAnchors,
+		reordered:           previousAlignment.reordered || currentAlignment.reordered,
+	}
+}
+
+// weightedMatches counts the matching ngrams of the current alignment, matches between equivalent ngrams
+// being weighted by equivalentMatchWeight
+func weightedMatches(m *matchValues, config *matchingParams) float64 {
+	return float64(m.matchesInCurrentAlignment-m.equivalentMatches) + float64(m.equivalentMatches)*config.equivalentMatchWeight
 }
 
 // Add alignments to list of alignments
@@ -953,9 +1507,10 @@ func addAlignment(m *matchValues, config *matchingParams, alignments *[]Alignmen
 	m.currentAlignment.source = position{m.firstMatch[0].startByte, m.lastMatch[0].endByte, m.firstMatch[0].index, m.lastMatch[0].index}
 	m.currentAlignment.target = position{m.firstMatch[1].startByte, m.lastMatch[1].endByte, m.firstMatch[1].index, m.lastMatch[1].index}
 	m.currentAlignment.totalMatchingNgrams = m.matchesInCurrentAlignment
-	if float32(m.commonNgramMatches/m.matchesInCurrentAlignment) >= config.commonNgramsLimit {
-		m.currentAlignment.banality = true
-	}
+	m.currentAlignment.fuzzyMatches = m.fuzzyMatches
+	m.currentAlignment.equivalentMatches = m.equivalentMatches
+	m.currentAlignment.translatedMatches = m.translatedMatches
+	m.currentAlignment.rareAnchors = m.rareAnchors
 	*alignments = append(*alignments, m.currentAlignment)
 	m.previousAlignment = m.currentAlignment
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// compositeSegment is one of the passages making up a composite borrowing
+type compositeSegment struct {
+	PassageID       string `json:"passage_id"`
+	SourceStartByte int64  `json:"source_start_byte"`
+	SourceEndByte   int64  `json:"source_end_byte"`
+	TargetStartByte int64  `json:"target_start_byte"`
+	TargetEndByte   int64  `json:"target_end_byte"`
+	TargetOrder     int    `json:"target_order"` // rank of the segment in the target, starting at 1
+}
+
+// compositeBorrowing links passages between the same source and target which were reused out of order
+// or split by inserted text. Segments are ordered as in the source.
+type compositeBorrowing struct {
+	CompositeID     string             `json:"composite_id"`
+	SourceDocID     string             `json:"source_doc_id"`
+	TargetDocID     string             `json:"target_doc_id"`
+	SourceStartByte int64              `json:"source_start_byte"`
+	SourceEndByte   int64              `json:"source_end_byte"`
+	TargetStartByte int64              `json:"target_start_byte"`
+	TargetEndByte   int64              `json:"target_end_byte"`
+	Transposed      bool               `json:"transposed"`
+	Segments        []compositeSegment `json:"segments"`
+}
+
+// compositeWriter numbers composite borrowings and writes them to their own results file
+type compositeWriter struct {
+	file   *os.File
+	counts int
+}
+
+func createCompositeOutputFile(config *matchingParams) *compositeWriter {
+	if config.compositeDistance == 0 {
+		return nil
+	}
+	compositeFile, err := os.Create(filepath.Join(config.outputPath, "composite_alignments.results"))
+	checkErr(err, "createCompositeOutputFile")
+	return &compositeWriter{compositeFile, 0}
+}
+
+// spanDistance returns the number of bytes separating two spans, 0 when they overlap
+func spanDistance(firstStart int64, firstEnd int64, secondStart int64, secondEnd int64) int64 {
+	if secondStart >= firstEnd {
+		return secondStart - firstEnd
+	} else if firstStart >= secondEnd {
+		return firstStart - secondEnd
+	}
+	return 0
+}
+
+// outOfOrder checks whether two alignments come in a different order in the target than in the source
+func outOfOrder(first *Alignment, second *Alignment) bool {
+	sourceOrder := first.source.startByte - second.source.startByte
+	targetOrder := first.target.startByte - second.target.startByte
+	return (sourceOrder < 0 && targetOrder > 0) || (sourceOrder > 0 && targetOrder < 0)
+}
+
+// splitApart checks whether two alignments come in the same order in both texts with more text between them
+// in the target than in the source, none of it aligned with the source: a passage split by inserted text
+func splitApart(alignments []Alignment, first int, second int) bool {
+	before, after := &alignments[first], &alignments[second]
+	if before.source.startByte > after.source.startByte {
+		before, after = after, before
+	}
+	if before.target.startByte >= after.target.startByte || before.target.endByte >= after.target.startByte {
+		return false
+	}
+	sourceGap := spanDistance(before.source.startByte, before.source.endByte, after.source.startByte, after.source.endByte)
+	if after.target.startByte-before.target.endByte <= sourceGap {
+		return false
+	}
+	for index := range alignments {
+		if index != first && index != second &&
+			alignments[index].target.startByte < after.target.startByte && alignments[index].target.endByte > before.target.endByte {
+			return false
+		}
+	}
+	return true
+}
+
+// detectComposites groups alignments between the same source and target which are within maxDistance bytes
+// of each other in both texts and either out of order in the target or split apart by unmatched target text:
+// monotonic neighbours are left to merging. Groups are numbered from 1 in compositeGroup.
+func detectComposites(alignments []Alignment, maxDistance int64) {
+	groups := make([]int, len(alignments))
+	for index := range groups {
+		groups[index] = index
+	}
+	var find func(index int) int
+	find = func(index int) int {
+		if groups[index] != index {
+			groups[index] = find(groups[index])
+		}
+		return groups[index]
+	}
+	for first := range alignments {
+		for second := first + 1; second < len(alignments); second++ {
+			if (!outOfOrder(&alignments[first], &alignments[second]) && !splitApart(alignments, first, second)) ||
+				spanDistance(alignments[first].source.startByte, alignments[first].source.endByte, alignments[second].source.startByte, alignments[second].source.endByte) > maxDistance ||
+				spanDistance(alignments[first].target.startByte, alignments[first].target.endByte, alignments[second].target.startByte, alignments[second].target.endByte) > maxDistance {
+				continue
+			}
+			if firstGroup, secondGroup := find(first), find(second); firstGroup != secondGroup {
+				groups[secondGroup] = firstGroup
+			}
+		}
+	}
+	groupSizes := make(map[int]int)
+	for index := range alignments {
+		groupSizes[find(index)]++
+	}
+	groupNumbers := make(map[int]int)
+	for index := range alignments {
+		group := find(index)
+		if groupSizes[group] < 2 {
+			continue
+		}
+		if _, ok := groupNumbers[group]; !ok {
+			groupNumbers[group] = len(groupNumbers) + 1
+		}
+		alignments[index].compositeGroup = groupNumbers[group]
+	}
+}
+
+// compositeIDs assigns an ID to every composite borrowing between a source and a target
+func (writer *compositeWriter) compositeIDs(alignments []Alignment) map[int]string {
+	ids := map[int]string{0: ""}
+	for _, alignment := range alignments {
+		if _, ok := ids[alignment.compositeGroup]; !ok {
+			writer.counts++
+			ids[alignment.compositeGroup] = strconv.Itoa(writer.counts)
+		}
+	}
+	return ids
+}
+
+// write outputs composite borrowings built from their segments, grouped by composite ID
+func (writer *compositeWriter) write(sourceDocID string, targetDocID string, segmentsByID map[string][]compositeSegment) {
+	compositeIDs := make([]string, 0, len(segmentsByID))
+	for compositeID := range segmentsByID {
+		compositeIDs = append(compositeIDs, compositeID)
+	}
+	sort.Slice(compositeIDs, func(i, j int) bool {
+		first, _ := strconv.Atoi(compositeIDs[i])
+		second, _ := strconv.Atoi(compositeIDs[j])
+		return first < second
+	})
+	for _, compositeID := range compositeIDs {
+		segments := segmentsByID[compositeID]
+		sort.Slice(segments, func(i, j int) bool { return segments[i].SourceStartByte < segments[j].SourceStartByte })
+		targetOrder := make([]int, len(segments))
+		for index := range targetOrder {
+			targetOrder[index] = index
+		}
+		sort.Slice(targetOrder, func(i, j int) bool {
+			return segments[targetOrder[i]].TargetStartByte < segments[targetOrder[j]].TargetStartByte
+		})
+		composite := compositeBorrowing{CompositeID: compositeID, SourceDocID: sourceDocID, TargetDocID: targetDocID,
+			SourceStartByte: segments[0].SourceStartByte, TargetStartByte: segments[targetOrder[0]].TargetStartByte, Segments: segments}
+		for rank, index := range targetOrder {
+			segments[index].TargetOrder = rank + 1
+			if rank != index {
+				composite.Transposed = true
+			}
+		}
+		for _, segment := range segments {
+			if segment.SourceEndByte > composite.SourceEndByte {
+				composite.SourceEndByte = segment.SourceEndByte
+			}
+			if segment.TargetEndByte > composite.TargetEndByte {
+				composite.TargetEndByte = segment.TargetEndByte
+			}
+		}
+		jsonString, _ := json.Marshal(composite)
+		jsonString = append(jsonString, "\n"...)
+		writer.file.Write(jsonString)
+	}
+}
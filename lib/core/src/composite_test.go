@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func alignmentAt(sourceStart int64, sourceEnd int64, targetStart int64, targetEnd int64) Alignment {
+	return Alignment{source: position{startByte: sourceStart, endByte: sourceEnd}, target: position{startByte: targetStart, endByte: targetEnd}}
+}
+
+func TestDetectCompositesLinksTransposedPassages(t *testing.T) {
+	alignments := []Alignment{alignmentAt(0, 100, 500, 600), alignmentAt(150, 250, 300, 400)}
+	detectComposites(alignments, 200)
+	if alignments[0].compositeGroup != 1 || alignments[1].compositeGroup != 1 {
+		t.Errorf("expected transposed passages in composite 1, got %d and %d", alignments[0].compositeGroup, alignments[1].compositeGroup)
+	}
+}
+
+func TestDetectCompositesIgnoresMonotonicPassages(t *testing.T) {
+	alignments := []Alignment{alignmentAt(0, 100, 300, 400), alignmentAt(150, 250, 420, 520)}
+	detectComposites(alignments, 200)
+	if alignments[0].compositeGroup != 0 || alignments[1].compositeGroup != 0 {
+		t.Errorf("monotonic passages flagged as composite: %d and %d", alignments[0].compositeGroup, alignments[1].compositeGroup)
+	}
+}
+
+func TestDetectCompositesLinksSplitPassages(t *testing.T) {
+	alignments := []Alignment{alignmentAt(0, 100, 300, 400), alignmentAt(120, 220, 550, 650)}
+	detectComposites(alignments, 200)
+	if alignments[0].compositeGroup != 1 || alignments[1].compositeGroup != 1 {
+		t.Errorf("expected passages split by inserted text in composite 1, got %d and %d", alignments[0].compositeGroup, alignments[1].compositeGroup)
+	}
+}
+
+func TestDetectCompositesIgnoresGapsFilledByOtherPassages(t *testing.T) {
+	alignments := []Alignment{alignmentAt(0, 100, 300, 400), alignmentAt(120, 220, 550, 650), alignmentAt(1000, 1100, 420, 530)}
+	detectComposites(alignments, 200)
+	if alignments[0].compositeGroup != 0 || alignments[1].compositeGroup != 0 {
+		t.Errorf("passages around another alignment flagged as split: %d and %d", alignments[0].compositeGroup, alignments[1].compositeGroup)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import "encoding/json"
+
+// diffOperation is a run of tokens which are equal in both passages, only in the target passage (insert),
+// or only in the source passage (delete). Offsets are token indexes within each passage, end excluded.
+type diffOperation struct {
+	Operation   string `json:"op"`
+	SourceStart int    `json:"source_start"`
+	SourceEnd   int    `json:"source_end"`
+	TargetStart int    `json:"target_start"`
+	TargetEnd   int    `json:"target_end"`
+	Text        string `json:"text"`
+}
+
+// passageDiff computes a word-level diff of the source and target passages and returns it serialized as JSON
+func passageDiff(sourcePosition *position, targetPosition *position, sourceFilename string, targetFilename string, config *matchingParams) string {
+	sourceDoc := documentTexts.get(sourceFilename, config.sourceEncoding)
+	targetDoc := documentTexts.get(targetFilename, config.targetEncoding)
+	sourceStart, sourceEnd := sourceDoc.cleanRange(sourcePosition.startByte, sourcePosition.endByte)
+	targetStart, targetEnd := targetDoc.cleanRange(targetPosition.startByte, targetPosition.endByte)
+	sourceTokens := sourceDoc.tokensBetween(sourceStart, sourceEnd)
+	targetTokens := targetDoc.tokensBetween(targetStart, targetEnd)
+	operations := diffTokens(sourceTokens, targetTokens)
+	for index := range operations {
+		operation := &operations[index]
+		if operation.Operation == "insert" {
+			operation.Text = targetDoc.slice(targetTokens[operation.TargetStart].start, targetTokens[operation.TargetEnd-1].end)
+		} else {
+			operation.Text = sourceDoc.slice(sourceTokens[operation.SourceStart].start, sourceTokens[operation.SourceEnd-1].end)
+		}
+	}
+	jsonString, _ := json.Marshal(operations)
+	return string(jsonString)
+}
+
+// maxDiffCells caps the size of the longest common subsequence table of a diff, so that long passages
+// don't exhaust memory
+const maxDiffCells = 4000000
+
+// diffTokens aligns two token lists on their longest common subsequence and groups consecutive tokens
+// sharing the same operation. Beyond their common prefix and suffix, token lists too long for the
+// longest common subsequence table are diffed as a plain replacement of the source tokens by the target tokens.
+func diffTokens(sourceTokens []textToken, targetTokens []textToken) []diffOperation {
+	prefix := 0
+	for prefix < len(sourceTokens) && prefix < len(targetTokens) && sourceTokens[prefix].text == targetTokens[prefix].text {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(sourceTokens)-prefix && suffix < len(targetTokens)-prefix &&
+		sourceTokens[len(sourceTokens)-1-suffix].text == targetTokens[len(targetTokens)-1-suffix].text {
+		suffix++
+	}
+	source := sourceTokens[prefix : len(sourceTokens)-suffix]
+	target := targetTokens[prefix : len(targetTokens)-suffix]
+
+	// lcsLengths[i][j] is the length of the longest common subsequence of source[i:] and target[j:]
+	var lcsLengths [][]int32
+	replace := (len(source)+1)*(len(target)+1) > maxDiffCells
+	if !replace {
+		lcsLengths = make([][]int32, len(source)+1)
+		for i := range lcsLengths {
+			lcsLengths[i] = make([]int32, len(target)+1)
+		}
+		for i := len(source) - 1; i >= 0; i-- {
+			for j := len(target) - 1; j >= 0; j-- {
+				if source[i].text == target[j].text {
+					lcsLengths[i][j] = lcsLengths[i+1][j+1] + 1
+				} else if lcsLengths[i+1][j] >= lcsLengths[i][j+1] {
+					lcsLengths[i][j] = lcsLengths[i+1][j]
+				} else {
+					lcsLengths[i][j] = lcsLengths[i][j+1]
+				}
+			}
+		}
+	}
+
+	operations := []diffOperation{}
+	addOperation := func(operation string, sourceIndex int, targetIndex int) {
+		sourceLength, targetLength := 1, 1
+		if operation == "insert" {
+			sourceLength = 0
+		} else if operation == "delete" {
+			targetLength = 0
+		}
+		if last := len(operations) - 1; last >= 0 && operations[last].Operation == operation {
+			operations[last].SourceEnd += sourceLength
+			operations[last].TargetEnd += targetLength
+			return
+		}
+		operations = append(operations, diffOperation{Operation: operation, SourceStart: sourceIndex, SourceEnd: sourceIndex + sourceLength,
+			TargetStart: targetIndex, TargetEnd: targetIndex + targetLength})
+	}
+	for index := 0; index < prefix; index++ {
+		addOperation("equal", index, index)
+	}
+	i, j := 0, 0
+	for i < len(source) || j < len(target) {
+		switch {
+		case replace:
+			if i < len(source) {
+				addOperation("delete", prefix+i, prefix+j)
+				i++
+			} else {
+				addOperation("insert", prefix+i, prefix+j)
+				j++
+			}
+		case i < len(source) && j < len(target) && source[i].text == target[j].text:
+			addOperation("equal", prefix+i, prefix+j)
+			i++
+			j++
+		case j == len(target) || (i < len(source) && lcsLengths[i+1][j] >= lcsLengths[i][j+1]):
+			addOperation("delete", prefix+i, prefix+j)
+			i++
+		default:
+			addOperation("insert", prefix+i, prefix+j)
+			j++
+		}
+	}
+	for index := 0; index < suffix; index++ {
+		addOperation("equal", prefix+len(source)+index, prefix+len(target)+index)
+	}
+	return operations
+}
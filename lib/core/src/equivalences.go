@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// loadEquivalences reads a file of equivalence classes, such as synonyms or inflected forms and their lemma:
+// each line lists equivalent tokens or ngrams separated by tabs, commas or spaces, and lines starting with # are ignored.
+// Ngrams join their tokens with underscores, and all entries should be preprocessed like the ngram indexes.
+// Entries are first replaced by their OCR representative so that equivalences also apply to OCR variants.
+func loadEquivalences(fileLocation string, similarTokens map[string]string) (map[string]string, map[string]string) {
+	file, err := os.Open(fileLocation)
+	checkErr(err, "loadEquivalences")
+	defer file.Close()
+	tokenClasses, ngramClasses := unionFind{}, unionFind{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var firstToken, firstNgram string
+		for _, entry := range strings.FieldsFunc(strings.ToLower(line), func(char rune) bool { return char == ',' || unicode.IsSpace(char) }) {
+			tokens := strings.Split(entry, ngramTokenSeparator)
+			for index, token := range tokens {
+				if representative, ok := similarTokens[token]; ok {
+					tokens[index] = representative
+				}
+			}
+			entry = strings.Join(tokens, ngramTokenSeparator)
+			if len(tokens) == 1 {
+				if firstToken == "" {
+					firstToken = entry
+				}
+				tokenClasses.union(firstToken, entry)
+			} else {
+				if firstNgram == "" {
+					firstNgram = entry
+				}
+				ngramClasses.union(firstNgram, entry)
+			}
+		}
+	}
+	checkErr(scanner.Err(), "loadEquivalences")
+	return tokenClasses.representatives(), ngramClasses.representatives()
+}
+
+// borrowingType classifies a passage as verbatim or paraphrastic depending on its share of equivalent matching ngrams
+func borrowingType(alignment *Alignment, config *matchingParams) string {
+	if float64(alignment.equivalentMatches)/float64(alignment.totalMatchingNgrams) > config.paraphraseThreshold {
+		return "paraphrastic"
+	}
+	return "verbatim"
+}
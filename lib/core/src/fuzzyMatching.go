@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Separator of tokens in the ngrams of index.tab files
+const ngramTokenSeparator = "_"
+
+// Common OCR confusions in early modern prints, replaced when building token skeletons.
+// Multi-character confusions are replaced first.
+var ocrConfusions = strings.NewReplacer("rn", "m", "vv", "w", "ii", "u", "cl", "d")
+var ocrCharacterConfusions = strings.NewReplacer("f", "s", "v", "u", "j", "i", "y", "i", "l", "i", "1", "i", "0", "o", "5", "s", "e", "c")
+
+// fuzzyIndex maps the hashes of ngrams whose tokens are OCR variants or equivalents of each other to a shared
+// derived key, so that docs re-indexed on these keys match variants of the same ngram
+type fuzzyIndex struct {
+	keys     map[int64]int64 // ngram hash to derived key, only for ngrams with at least one variant
+	ocrForms map[int64]int64 // ngram hash to the key of its OCR normalized form, used to tell OCR variants from equivalents
+}
+
+// variantOptions define which variants of ngrams are matched
+type variantOptions struct {
+	ocr             bool
+	maxDistance     int
+	minLength       int
+	equivalenceFile string
+}
+
+// unionFind groups tokens or ngrams into classes represented by their smallest member
+type unionFind map[string]string
+
+func (classes unionFind) find(member string) string {
+	parent, ok := classes[member]
+	if !ok {
+		classes[member] = member
+		return member
+	}
+	if parent != member {
+		classes[member] = classes.find(parent)
+	}
+	return classes[member]
+}
+
+func (classes unionFind) union(first string, second string) {
+	firstRoot, secondRoot := classes.find(first), classes.find(second)
+	if firstRoot < secondRoot {
+		classes[secondRoot] = firstRoot
+	} else if secondRoot < firstRoot {
+		classes[firstRoot] = secondRoot
+	}
+}
+
+// representatives maps every member of a class with at least two members to the representative of its class
+func (classes unionFind) representatives() map[string]string {
+	table := make(map[string]string)
+	for member := range classes {
+		if root := classes.find(member); root != member {
+			table[member] = root
+		}
+	}
+	return table
+}
+
+var fuzzyNgrams *fuzzyIndex
+
+// ocrSkeleton normalizes characters which are often confused by OCR engines and collapses doubled letters
+func ocrSkeleton(token string) string {
+	normalized := ocrCharacterConfusions.Replace(ocrConfusions.Replace(token))
+	skeleton := make([]rune, 0, len(normalized))
+	for _, char := range normalized {
+		if len(skeleton) > 0 && skeleton[len(skeleton)-1] == char {
+			continue
+		}
+		skeleton = append(skeleton, char)
+	}
+	return string(skeleton)
+}
+
+// editDistance returns the Levenshtein distance between two tokens
+func editDistance(first string, second string) int {
+	firstRunes, secondRunes := []rune(first), []rune(second)
+	previousRow := make([]int, len(secondRunes)+1)
+	currentRow := make([]int, len(secondRunes)+1)
+	for j := range previousRow {
+		previousRow[j] = j
+	}
+	for i := 1; i <= len(firstRunes); i++ {
+		currentRow[0] = i
+		for j := 1; j <= len(secondRunes); j++ {
+			cost := 1
+			if firstRunes[i-1] == secondRunes[j-1] {
+				cost = 0
+			}
+			currentRow[j] = minInt(minInt(previousRow[j]+1, currentRow[j-1]+1), previousRow[j-1]+cost)
+		}
+		previousRow, currentRow = currentRow, previousRow
+	}
+	return previousRow[len(secondRunes)]
+}
+
+func minInt(first int, second int) int {
+	if first < second {
+		return first
+	}
+	return second
+}
+
+// deletionVariants returns all variants of a token with up to maxDeletions characters removed:
+// two tokens within maxDeletions edits of each other share at least one variant
+func deletionVariants(token string, maxDeletions int) []string {
+	variants := []string{token}
+	seen := map[string]bool{token: true}
+	current := []string{token}
+	for deletion := 0; deletion < maxDeletions; deletion++ {
+		next := []string{}
+		for _, variant := range current {
+			runes := []rune(variant)
+			for index := range runes {
+				shorter := string(runes[:index]) + string(runes[index+1:])
+				if !seen[shorter] {
+					seen[shorter] = true
+					next = append(next, shorter)
+				}
+			}
+		}
+		variants = append(variants, next...)
+		current = next
+	}
+	return variants
+}
+
+// canonicalFrequencyRatio is how many times more ngrams a canonical form must be found in than its variants:
+// OCR errors are rare compared to the word they garble, while two frequent words are distinct words
+const canonicalFrequencyRatio = 4
+
+// tokenSimilarityTable maps tokens to the canonical form they are an OCR variant of. Tokens are visited from
+// the most to the least frequent: a token becomes a variant of a canonical form found in canonicalFrequencyRatio
+// times as many ngrams when it shares its OCR skeleton or is within maxDistance edits of it, and a canonical form
+// otherwise. Variants are never compared to each other, so groups do not chain through intermediate tokens,
+// and tokens close to several canonical forms are left alone. Tokens shorter than minLength characters are
+// never grouped since short words differing by one character are rarely OCR variants.
+func tokenSimilarityTable(tokenFrequencies map[string]int, maxDistance int, minLength int) map[string]string {
+	tokens := make([]string, 0, len(tokenFrequencies))
+	for token := range tokenFrequencies {
+		if len([]rune(token)) >= minLength {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokenFrequencies[tokens[i]] != tokenFrequencies[tokens[j]] {
+			return tokenFrequencies[tokens[i]] > tokenFrequencies[tokens[j]]
+		}
+		return tokens[i] < tokens[j]
+	})
+	table := make(map[string]string)
+	canonicalBySkeleton := make(map[string][]string)
+	canonicalByVariant := make(map[string][]string)
+	for _, token := range tokens {
+		skeleton := ocrSkeleton(token)
+		candidates := make(map[string]int)
+		for _, canonical := range canonicalBySkeleton[skeleton] {
+			candidates[canonical] = 0
+		}
+		var variants []string
+		if maxDistance > 0 {
+			variants = deletionVariants(token, maxDistance)
+			for _, variant := range variants {
+				for _, canonical := range canonicalByVariant[variant] {
+					if _, ok := candidates[canonical]; ok {
+						continue
+					}
+					if distance := editDistance(token, canonical); distance <= maxDistance {
+						candidates[canonical] = distance
+					}
+				}
+			}
+		}
+		best, bestDistance, ambiguous := "", maxDistance+1, false
+		for canonical, distance := range candidates {
+			if tokenFrequencies[canonical] < canonicalFrequencyRatio*tokenFrequencies[token] {
+				continue
+			}
+			if distance < bestDistance {
+				best, bestDistance, ambiguous = canonical, distance, false
+			} else if distance == bestDistance {
+				ambiguous = true
+			}
+		}
+		if best != "" && !ambiguous {
+			table[token] = best
+			continue
+		}
+		canonicalBySkeleton[skeleton] = append(canonicalBySkeleton[skeleton], token)
+		for _, variant := range variants {
+			canonicalByVariant[variant] = append(canonicalByVariant[variant], token)
+		}
+	}
+	return table
+}
+
+// readIndexedNgrams reads the ngrams and their hashes from an index.tab file
+func readIndexedNgrams(fileLocation string, ngrams map[int64]string) {
+	file, err := os.Open(fileLocation)
+	checkErr(err, "readIndexedNgrams")
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		values := strings.Split(strings.TrimSpace(line), "\t")
+		if len(values) == 2 {
+			hash, _ := strconv.ParseInt(values[1], 10, 64)
+			ngrams[hash] = values[0]
+		}
+	}
+}
+
+// newFuzzyIndex builds the token similarity table from the vocabulary of the source and target ngram indexes,
+// and derives a shared key for every group of ngrams whose tokens are all similar or equivalent
+func newFuzzyIndex(sourceIndex string, targetIndex string, options variantOptions) *fuzzyIndex {
+	fmt.Printf("Building token similarity table for fuzzy matching...")
+	ngrams := make(map[int64]string)
+	for _, indexLocation := range []string{sourceIndex, targetIndex} {
+		if indexLocation != "" {
+			readIndexedNgrams(indexLocation, ngrams)
+		}
+	}
+	tokenFrequencies := make(map[string]int)
+	for _, ngram := range ngrams {
+		for _, token := range strings.Split(ngram, ngramTokenSeparator) {
+			tokenFrequencies[token]++
+		}
+	}
+	similarTokens := map[string]string{}
+	if options.ocr {
+		similarTokens = tokenSimilarityTable(tokenFrequencies, options.maxDistance, options.minLength)
+	}
+	equivalentTokens, equivalentNgrams := map[string]string{}, map[string]string{}
+	if options.equivalenceFile != "" {
+		equivalentTokens, equivalentNgrams = loadEquivalences(options.equivalenceFile, similarTokens)
+	}
+
+	ngramsByKey := make(map[int64][]int64)
+	ocrForms := make(map[int64]int64, len(ngrams))
+	for hash, ngram := range ngrams {
+		tokens := strings.Split(ngram, ngramTokenSeparator)
+		for index, token := range tokens {
+			if representative, ok := similarTokens[token]; ok {
+				tokens[index] = representative
+			}
+		}
+		ocrForm := strings.Join(tokens, ngramTokenSeparator)
+		normalizedNgram, ok := equivalentNgrams[ocrForm]
+		if !ok {
+			for index, token := range tokens {
+				if representative, ok := equivalentTokens[token]; ok {
+					tokens[index] = representative
+				}
+			}
+			normalizedNgram = strings.Join(tokens, ngramTokenSeparator)
+		}
+		key := fuzzyKey(normalizedNgram)
+		ngramsByKey[key] = append(ngramsByKey[key], hash)
+		ocrForms[hash] = fuzzyKey(ocrForm)
+	}
+	index := &fuzzyIndex{make(map[int64]int64), make(map[int64]int64)}
+	for key, hashes := range ngramsByKey {
+		if len(hashes) < 2 {
+			continue // no variant of this ngram: keep matching on its own hash
+		}
+		for _, hash := range hashes {
+			index.keys[hash] = key
+			index.ocrForms[hash] = ocrForms[hash]
+		}
+	}
+	fmt.Printf(" %d ngrams have variants.\n", len(index.keys))
+	return index
+}
+
+// fuzzyKey hashes the normalized form of an ngram. Keys are above the 32-bit range so they never collide
+// with 32-bit ngram hashes, and are unlikely to collide with 64-bit ones.
+func fuzzyKey(normalizedNgram string) int64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(normalizedNgram))
+	return int64(hasher.Sum64()>>2 | 1<<62)
+}
+
+// rekey moves ngrams with variants to their derived key, keeping track of their original hash
+// by ngram position so that matches between different variants can be flagged
+func (index *fuzzyIndex) rekey(doc *docIndex) {
+	rekeyedNgrams := make(map[int64][]indexedNgram, len(doc.Ngrams))
+	doc.Variants = make(map[int64]int64)
+	for hash, ngrams := range doc.Ngrams {
+		key, ok := index.keys[hash]
+		if !ok {
+			rekeyedNgrams[hash] = append(rekeyedNgrams[hash], ngrams...)
+			continue
+		}
+		for _, ngram := range ngrams {
+			doc.Variants[ngram.index] = hash
+		}
+		rekeyedNgrams[key] = append(rekeyedNgrams[key], ngrams...)
+	}
+	doc.Ngrams = rekeyedNgrams
+	doc.NgramLength = len(rekeyedNgrams)
+}
+
+// rekeyCommonNgrams adds the derived keys of common ngrams to the list of common ngrams
+func (index *fuzzyIndex) rekeyCommonNgrams(commonNgrams map[int64]bool) {
+	for hash := range commonNgrams {
+		if key, ok := index.keys[hash]; ok {
+			commonNgrams[key] = true
+		}
+	}
+}
+
+// matchVariants checks whether source and target ngrams matched through different variants: OCR variants
+// share the same OCR normalized form, while other variants are matched through equivalences
+func matchVariants(sourceFile *docIndex, targetFile *docIndex, source indexedNgram, target indexedNgram) (bool, bool) {
+	if fuzzyNgrams == nil {
+		return false, false
+	}
+	sourceHash, ok := sourceFile.Variants[source.index]
+	if !ok {
+		return false, false
+	}
+	targetHash := targetFile.Variants[target.index]
+	if sourceHash == targetHash {
+		return false, false
+	}
+	if fuzzyNgrams.ocrForms[sourceHash] == fuzzyNgrams.ocrForms[targetHash] {
+		return true, false
+	}
+	return false, true
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestTokenSimilarityTableKeepsFrequentWordsApart(t *testing.T) {
+	frequencies := map[string]int{"maison": 12, "saison": 8, "raison": 6, "saisir": 5, "rnaison": 2, "maisou": 1, "faison": 2}
+	table := tokenSimilarityTable(frequencies, 1, 5)
+	for _, token := range []string{"maison", "saison", "raison", "saisir"} {
+		if canonical, ok := table[token]; ok {
+			t.Errorf("frequent word %s mapped to %s", token, canonical)
+		}
+	}
+	expected := map[string]string{"rnaison": "maison", "maisou": "maison", "faison": "saison"}
+	for token, canonical := range expected {
+		if table[token] != canonical {
+			t.Errorf("expected %s to map to %s, got %q", token, canonical, table[token])
+		}
+	}
+}
+
+func TestTokenSimilarityTableIgnoresShortTokens(t *testing.T) {
+	table := tokenSimilarityTable(map[string]int{"les": 40, "ies": 1, "fait": 30, "sait": 1, "et": 50, "ct": 1}, 1, 5)
+	if len(table) != 0 {
+		t.Errorf("short tokens grouped: %v", table)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+)
+
+// inverseDocumentFrequency returns the log of the number of documents divided by the number of documents containing the ngram
+func inverseDocumentFrequency(ngram int64) float64 {
+	documentFrequency := corpusNgrams.documentFrequency[ngram]
+	if documentFrequency < 1 {
+		documentFrequency = 1
+	}
+	return math.Log(float64(corpusNgrams.totalDocs) / float64(documentFrequency))
+}
+
+// isRareNgram checks whether an ngram is found in at most rareNgramRatio of the documents of the corpus.
+// Since a matching ngram is found in at least the two documents of the pair, ngrams found in two documents
+// are always rare, whatever the size of the corpus.
+func isRareNgram(ngram int64, rareNgramRatio float64) bool {
+	return corpusNgrams.documentFrequency[ngram] <= int64(math.Max(2, rareNgramRatio*float64(corpusNgrams.totalDocs)))
+}
+
+// informativeness sums the inverse document frequency of the source ngrams of an alignment also found in its target passage,
+// counts those found in at most rareNgramRatio of documents, and divides the score by the number of source ngrams of the passage
+// so that short and long passages can be compared
+func informativeness(alignment *Alignment, sourcePositions []int64, targetPositions []int64, rareNgramRatio float64) (float64, int64, float64) {
+	targetNgrams := make(map[int64]bool)
+	for index := alignment.target.startNgramIndex; index <= alignment.target.endNgramIndex && index < int64(len(targetPositions)); index++ {
+		targetNgrams[targetPositions[index]] = true
+	}
+	score, rareNgrams, sourceNgrams := 0.0, int64(0), 0
+	for index := alignment.source.startNgramIndex; index <= alignment.source.endNgramIndex && index < int64(len(sourcePositions)); index++ {
+		ngram := sourcePositions[index]
+		if ngram == -1 {
+			continue
+		}
+		sourceNgrams++
+		if !targetNgrams[ngram] {
+			continue
+		}
+		score += inverseDocumentFrequency(ngram)
+		if isRareNgram(ngram, rareNgramRatio) {
+			rareNgrams++
+		}
+	}
+	if sourceNgrams == 0 {
+		return score, rareNgrams, 0
+	}
+	return score, rareNgrams, score / float64(sourceNgrams)
+}
+
+// countRareAnchor counts matches on rare ngrams in the current alignment and window when alignments require rare anchors
+func countRareAnchor(m *matchValues, match *ngramMatch, config *matchingParams) {
+	if config.minimumRareAnchors > 0 && isRareNgram(match.ngram, config.rareNgramRatio) {
+		m.rareAnchors++
+		m.rareAnchorsInCurrentWindow++
+	}
+}
+
+// windowHasRareAnchors checks whether the current matching window holds a rare anchor when alignments require them,
+// so that passages don't extend over spans of common ngrams on the strength of anchors found earlier
+func windowHasRareAnchors(m *matchValues, config *matchingParams) bool {
+	return config.minimumRareAnchors == 0 || m.rareAnchorsInCurrentWindow > 0
+}
+
+// hasRareAnchors checks whether the current alignment holds enough matches on rare ngrams
+func hasRareAnchors(m *matchValues, config *matchingParams) bool {
+	return m.rareAnchors >= config.minimumRareAnchors
+}
+
+// scoreInformativeness sets the IDF-weighted scores and rare ngram counts of alignments, and dismisses
+// those below the minimum IDF score or the minimum normalized IDF score
+func scoreInformativeness(alignments []Alignment, sourcePositions []int64, targetPositions []int64, config *matchingParams) []Alignment {
+	informativeAlignments := make([]Alignment, 0, len(alignments))
+	for _, alignment := range alignments {
+		alignment.idfScore, alignment.rareNgrams, alignment.normalizedIDFScore = informativeness(&alignment, sourcePositions, targetPositions, config.rareNgramRatio)
+		if alignment.idfScore < config.minimumIDFScore || alignment.normalizedIDFScore < config.minimumNormalizedIDFScore {
+			continue
+		}
+		informativeAlignments = append(informativeAlignments, alignment)
+	}
+	return informativeAlignments
+}
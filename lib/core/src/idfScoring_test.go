@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestIsRareNgramOnSmallCorpus(t *testing.T) {
+	corpusNgrams = &corpusStats{documentFrequency: map[int64]int64{1: 2, 2: 3}, totalDocs: 10}
+	defer func() { corpusNgrams = nil }()
+	if !isRareNgram(1, 0.01) {
+		t.Error("ngram found in the two documents of a pair should be rare")
+	}
+	if isRareNgram(2, 0.01) {
+		t.Error("ngram found in three of ten documents should not be rare")
+	}
+	alignment := Alignment{source: position{startNgramIndex: 0, endNgramIndex: 1}, target: position{startNgramIndex: 0, endNgramIndex: 1}}
+	if _, rareNgrams, _ := informativeness(&alignment, []int64{1, 2}, []int64{1, 2}, 0.01); rareNgrams != 1 {
+		t.Errorf("expected 1 rare ngram, got %d", rareNgrams)
+	}
+}
+
+func TestMatchingEndsAtWindowWithoutRareAnchor(t *testing.T) {
+	corpusNgrams = &corpusStats{documentFrequency: map[int64]int64{}, totalDocs: 10}
+	defer func() { corpusNgrams = nil }()
+	matches := []ngramMatch{}
+	for index := int64(0); index < 20; index++ {
+		ngram := index
+		if index >= 5 {
+			ngram = 100 + index
+			corpusNgrams.documentFrequency[ngram] = 8
+		} else {
+			corpusNgrams.documentFrequency[ngram] = 2
+		}
+		ngramPosition := indexedNgram{index, index * 10, index*10 + 20}
+		matches = append(matches, ngramMatch{source: ngramPosition, target: ngramPosition, ngram: ngram})
+	}
+	config := &matchingParams{matchingWindowSize: 5, maxGap: 5, minimumMatchingNgrams: 2, minimumMatchingNgramsInWindow: 1,
+		equivalentMatchWeight: 1, rareNgramRatio: 0.01, minimumRareAnchors: 1, matchingMode: "monotonic"}
+	for _, alignments := range [][]Alignment{matchPassage(&docIndex{}, &docIndex{}, matches, config, nil, nil), matchPassageUnordered(matches, config)} {
+		if len(alignments) != 1 {
+			t.Fatalf("expected 1 alignment, got %d", len(alignments))
+		}
+		if alignments[0].source.endNgramIndex >= 19 {
+			t.Errorf("alignment extended over windows without rare anchors up to ngram %d", alignments[0].source.endNgramIndex)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import "sort"
+
+// matchAllOccurrences runs the matching function again on the matches not covered by the passages already found,
+// so that every target occurrence of a reused source passage, and every source of a target passage, is aligned.
+// Each run finds, refines and merges passages on its own. Passages overlapping an already found passage
+// in both source and target are dropped.
+func matchAllOccurrences(matches []ngramMatch, match func(matches []ngramMatch) []Alignment) []Alignment {
+	alignments := match(matches)
+	found := alignments
+	for len(found) > 0 {
+		matches = uncoveredMatches(matches, found)
+		found = nonOverlappingAlignments(match(matches), alignments)
+		alignments = append(alignments, found...)
+	}
+	sort.SliceStable(alignments, func(i, j int) bool {
+		if alignments[i].source.startByte != alignments[j].source.startByte {
+			return alignments[i].source.startByte < alignments[j].source.startByte
+		}
+		return alignments[i].target.startByte < alignments[j].target.startByte
+	})
+	return alignments
+}
+
+func coversMatch(alignment *Alignment, match *ngramMatch) bool {
+	return match.source.index >= alignment.source.startNgramIndex && match.source.index <= alignment.source.endNgramIndex &&
+		match.target.index >= alignment.target.startNgramIndex && match.target.index <= alignment.target.endNgramIndex
+}
+
+// uncoveredMatches keeps matches which are outside of all alignments, in either source or target
+func uncoveredMatches(matches []ngramMatch, alignments []Alignment) []ngramMatch {
+	remainingMatches := make([]ngramMatch, 0, len(matches))
+	for _, match := range matches {
+		covered := false
+		for index := range alignments {
+			if coversMatch(&alignments[index], &match) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			remainingMatches = append(remainingMatches, match)
+		}
+	}
+	return remainingMatches
+}
+
+func overlaps(first *position, second *position) bool {
+	return first.startByte < second.endByte && second.startByte < first.endByte
+}
+
+// nonOverlappingAlignments drops new alignments overlapping an existing one in both source and target
+func nonOverlappingAlignments(newAlignments []Alignment, alignments []Alignment) []Alignment {
+	keptAlignments := make([]Alignment, 0, len(newAlignments))
+	for _, newAlignment := range newAlignments {
+		duplicate := false
+		for index := range alignments {
+			if overlaps(&newAlignment.source, &alignments[index].source) && overlaps(&newAlignment.target, &alignments[index].target) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			keptAlignments = append(keptAlignments, newAlignment)
+		}
+	}
+	return keptAlignments
+}
+
+// countOccurrences counts for each alignment the passages of the same document pair overlapping its source
+// and its target, including itself
+func countOccurrences(alignments []Alignment) {
+	for first := range alignments {
+		alignments[first].sourceOccurrences, alignments[first].targetOccurrences = 0, 0
+		for second := range alignments {
+			if overlaps(&alignments[first].source, &alignments[second].source) {
+				alignments[first].sourceOccurrences++
+			}
+			if overlaps(&alignments[first].target, &alignments[second].target) {
+				alignments[first].targetOccurrences++
+			}
+		}
+	}
+}
@@ -126,7 +126,7 @@ func extractFields(fields map[string]string, prefix string) map[string]string {
 	return extractedFields
 }
 
-func mergeSourcePassages(passages []map[string]string, mergedSourcePassages []*passageGroup, groupID *int, mergedTargetPassages map[string][]*passagePosition) {
+func mergeSourcePassages(passages []map[string]string, mergedSourcePassages []*passageGroup, groupID *int, mergedTargetPassages map[string][]*passagePosition, encoding string) {
 	sort.Slice(passages, func(i, j int) bool {
 		if passages[i]["source_start_byte"] < passages[j]["source_start_byte"] {
 			return true
@@ -149,7 +149,7 @@ func mergeSourcePassages(passages []map[string]string, mergedSourcePassages []*p
 			passageGroupUpdate(currentGroup, passage, groupID, mergedTargetPassages)
 		} else {
 			filename := passage["source_filename"]
-			currentGroup.sourcePassage = getText(&filename, int32(currentGroup.startByte), int32(currentGroup.endByte))
+			currentGroup.sourcePassage = documentTexts.passage(filename, encoding, int64(currentGroup.startByte), int64(currentGroup.endByte))
 			currentGroup = passageGroupInit(passage, groupID, mergedTargetPassages)
 		}
 	}
@@ -219,7 +219,7 @@ func mergeAlignments(config *matchingParams, alignmentCount int) {
 
 		currentDocID, _ := strconv.Atoi(sourceDocID)
 		if docID != currentDocID && docID != -1 {
-			mergeSourcePassages(passages, mergedSourcePassages, &groupID, mergedTargetPassages)
+			mergeSourcePassages(passages, mergedSourcePassages, &groupID, mergedTargetPassages, config.sourceEncoding)
 			passages = []map[string]string{}
 		}
 
@@ -231,7 +231,7 @@ func mergeAlignments(config *matchingParams, alignmentCount int) {
 		}
 	}
 	if len(passages) > 0 {
-		mergeSourcePassages(passages, mergedSourcePassages, &groupID, mergedTargetPassages)
+		mergeSourcePassages(passages, mergedSourcePassages, &groupID, mergedTargetPassages, config.sourceEncoding)
 		passages = []map[string]string{}
 	}
 
@@ -274,11 +274,17 @@ func mergeAlignments(config *matchingParams, alignmentCount int) {
 				fields[field] = value
 			}
 		}
-		textPosition := position{int32(currentPassageGroup.startByte), int32(currentPassageGroup.endByte), 0, 0}
-		textPassages := alignmentToText(&textPosition, currentPassageGroup.filename, config)
+		textPosition := position{int64(currentPassageGroup.startByte), int64(currentPassageGroup.endByte), 0, 0}
+		textPassages := alignmentToText(&textPosition, currentPassageGroup.filename, config.sourceEncoding, config)
 		fields["source_context_before"] = textPassages[0]
 		fields["source_passage"] = textPassages[1]
 		fields["source_context_after"] = textPassages[2]
+		if config.citations {
+			addCitationFields(fields, "source_", documentTexts.get(currentPassageGroup.filename, config.sourceEncoding), &textPosition)
+		}
+		if philoDocuments != nil {
+			addPhiloFields(fields, "source_", philoDocuments.get(philoDocuments.sourceWordsDir, fields["source_doc_id"]), &textPosition, config.philoLinkTemplate, config.sourcePhiloDBLink)
+		}
 		jsonString, _ := json.Marshal(fields)
 		jsonString = append(jsonString, "\n"...)
 		passageSources.Write(jsonString)
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Context around passages can be measured in bytes (the default), tokens, sentences or paragraphs.
+// Outside of byte mode, contexts always start and end on token, sentence or paragraph boundaries.
+var contextModes = map[string]bool{"bytes": true, "tokens": true, "sentences": true, "paragraph": true}
+
+// sentenceRules define how sentences end in a given language
+type sentenceRules struct {
+	terminators   string
+	abbreviations map[string]bool // lowercased words which are not ending a sentence when followed by a period
+}
+
+var defaultSentenceRules = sentenceRules{".?!…", map[string]bool{}}
+
+var sentenceRulesByLanguage = map[string]sentenceRules{
+	"english": {".?!…", wordSet("mr mrs ms dr st prof rev jr sr vs etc vol ch no")},
+	"french":  {".?!…", wordSet("m mm mme mmes mlle mlles mgr dr st ste etc vol ch chap liv p")},
+	"german":  {".?!…", wordSet("hr fr dr st nr vgl bzw usw ca bd kap")},
+	"italian": {".?!…", wordSet("sig sigg dott prof ecc cap vol")},
+	"spanish": {".?!…", wordSet("sr sra srta dr dña ud uds etc cap vol")},
+	"latin":   {".?!", wordSet("cap lib c l v")},
+	"greek":   {".;\u037e·\u0387!", wordSet("")},
+}
+
+// Characters which may sit between a sentence terminator and the following space, like closing quotes
+const sentenceClosers = `"'»”’)]`
+
+func wordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+	return set
+}
+
+func getSentenceRules(language string) sentenceRules {
+	if rules, ok := sentenceRulesByLanguage[strings.ToLower(language)]; ok {
+		return rules
+	}
+	return defaultSentenceRules
+}
+
+func checkContextMode(mode string) error {
+	if !contextModes[mode] {
+		return fmt.Errorf("unknown context mode %s: use bytes, tokens, sentences or paragraph", mode)
+	}
+	return nil
+}
+
+// contextBounds returns where the context before start and the context after end begin and end in the cleaned text.
+// The size is expressed in tokens or sentences, and is ignored in paragraph mode where the enclosing paragraph is used.
+func (doc *cleanedText) contextBounds(start int, end int, mode string, size int, rules sentenceRules) (int, int) {
+	switch mode {
+	case "tokens":
+		return doc.tokensBefore(start, size), doc.tokensAfter(end, size)
+	case "sentences":
+		return doc.sentencesBefore(start, size, rules), doc.sentencesAfter(end, size, rules)
+	case "paragraph":
+		return doc.paragraphStart(start), doc.paragraphEnd(end)
+	}
+	return start, end
+}
+
+func isWordRune(char rune) bool {
+	return unicode.IsLetter(char) || unicode.IsDigit(char) || unicode.IsMark(char)
+}
+
+// tokensBefore returns the start of the nth token preceding position
+func (doc *cleanedText) tokensBefore(position int, n int) int {
+	count := 0
+	for position > 0 && count < n {
+		char, width := utf8.DecodeLastRune(doc.text[:position])
+		position -= width
+		if isWordRune(char) {
+			previousChar, _ := utf8.DecodeLastRune(doc.text[:position])
+			if position == 0 || !isWordRune(previousChar) {
+				count++
+			}
+		}
+	}
+	return position
+}
+
+// tokensAfter returns the end of the nth token following position, including any punctuation attached to it
+func (doc *cleanedText) tokensAfter(position int, n int) int {
+	count := 0
+	for position < len(doc.text) && count < n {
+		char, width := utf8.DecodeRune(doc.text[position:])
+		position += width
+		if isWordRune(char) {
+			nextChar, _ := utf8.DecodeRune(doc.text[position:])
+			if position == len(doc.text) || !isWordRune(nextChar) {
+				count++
+			}
+		}
+	}
+	for position < len(doc.text) {
+		char, width := utf8.DecodeRune(doc.text[position:])
+		if char == ' ' || isWordRune(char) {
+			break
+		}
+		position += width
+	}
+	return position
+}
+
+// sentencesBefore returns the start of the nth sentence start preceding position
+func (doc *cleanedText) sentencesBefore(position int, n int, rules sentenceRules) int {
+	count := 0
+	for position > 0 {
+		_, width := utf8.DecodeLastRune(doc.text[:position])
+		position -= width
+		if doc.isSentenceStart(position, rules) {
+			count++
+			if count == n {
+				break
+			}
+		}
+	}
+	return position
+}
+
+// sentencesAfter returns the end of the nth sentence ending after position
+func (doc *cleanedText) sentencesAfter(position int, n int, rules sentenceRules) int {
+	count := 0
+	for position < len(doc.text) {
+		_, width := utf8.DecodeRune(doc.text[position:])
+		position += width
+		if doc.isSentenceEnd(position, rules) {
+			count++
+			if count == n {
+				break
+			}
+		}
+	}
+	return position
+}
+
+func (doc *cleanedText) isSentenceStart(position int, rules sentenceRules) bool {
+	if position == 0 || doc.isParagraphBreak(position) {
+		return true
+	}
+	if doc.text[position] == ' ' || doc.text[position-1] != ' ' {
+		return false
+	}
+	return doc.isSentenceEnd(position-1, rules)
+}
+
+// isSentenceEnd checks whether a sentence ends right before position
+func (doc *cleanedText) isSentenceEnd(position int, rules sentenceRules) bool {
+	if position == len(doc.text) || doc.isParagraphBreak(position) {
+		return true
+	}
+	if doc.text[position] != ' ' {
+		return false
+	}
+	char, width := utf8.DecodeLastRune(doc.text[:position])
+	for strings.ContainsRune(sentenceClosers, char) && position-width > 0 {
+		position -= width
+		char, width = utf8.DecodeLastRune(doc.text[:position])
+	}
+	if !strings.ContainsRune(rules.terminators, char) {
+		return false
+	}
+	if char == '.' {
+		wordEnd := position - width
+		wordStart := wordEnd
+		for wordStart > 0 {
+			previousChar, previousWidth := utf8.DecodeLastRune(doc.text[:wordStart])
+			if !isWordRune(previousChar) {
+				break
+			}
+			wordStart -= previousWidth
+		}
+		word := string(doc.text[wordStart:wordEnd])
+		if rules.abbreviations[strings.ToLower(word)] {
+			return false
+		}
+		if firstChar, _ := utf8.DecodeRuneInString(word); utf8.RuneCountInString(word) == 1 && unicode.IsUpper(firstChar) { // initials
+			return false
+		}
+	}
+	return true
+}
+
+func (doc *cleanedText) isParagraphBreak(position int) bool {
+	index := sort.SearchInts(doc.paragraphBreaks, position)
+	return index < len(doc.paragraphBreaks) && doc.paragraphBreaks[index] == position
+}
+
+// paragraphStart returns the start of the paragraph enclosing position
+func (doc *cleanedText) paragraphStart(position int) int {
+	index := sort.SearchInts(doc.paragraphBreaks, position+1) - 1
+	if index < 0 {
+		return 0
+	}
+	return doc.paragraphBreaks[index]
+}
+
+// paragraphEnd returns the end of the paragraph enclosing position
+func (doc *cleanedText) paragraphEnd(position int) int {
+	index := sort.SearchInts(doc.paragraphBreaks, position)
+	if index == len(doc.paragraphBreaks) {
+		return len(doc.text)
+	}
+	return doc.paragraphBreaks[index]
+}
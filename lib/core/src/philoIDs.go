@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// philoStore gives access to the word positions of PhiloLogic databases, which are used
+// to find the PhiloLogic objects containing aligned passages
+type philoStore struct {
+	sourceWordsDir string
+	targetWordsDir string
+	cache          *lruCache
+}
+
+// philoWords holds the philo_id of every word of a PhiloLogic document, sorted by start byte
+type philoWords struct {
+	startBytes []int64
+	philoIDs   [][]string
+}
+
+type philoWord struct {
+	Position  string `json:"position"`
+	StartByte int64  `json:"start_byte"`
+}
+
+// PhiloLogic object levels as indexes in a philo_id
+const (
+	philoDivDepth  = 4
+	philoParaDepth = 5
+	philoSentDepth = 6
+)
+
+var philoDocuments *philoStore
+
+func newPhiloStore(sourceWordsDir string, targetWordsDir string, maxDocs int) *philoStore {
+	return &philoStore{sourceWordsDir, targetWordsDir, newLRUCache(maxDocs)}
+}
+
+// get returns the word positions of the PhiloLogic document containing the text object docID
+func (store *philoStore) get(wordsDir string, docID string) *philoWords {
+	philoDocID := strings.Split(docID, "_")[0] // text objects below doc level are named after their philo_id
+	wordsFile := filepath.Join(wordsDir, philoDocID)
+	return store.cache.getOrLoad(wordsFile, func() interface{} {
+		return loadPhiloWords(wordsFile)
+	}).(*philoWords)
+}
+
+// loadPhiloWords reads a words_and_philo_ids file: one JSON object per word, optionally gzipped
+func loadPhiloWords(wordsFile string) *philoWords {
+	if _, err := os.Stat(wordsFile); os.IsNotExist(err) {
+		if _, err := os.Stat(wordsFile + ".lz4"); err == nil {
+			checkErr(fmt.Errorf("%s.lz4 is lz4 compressed: decompress words_and_philo_ids files first", wordsFile), "loadPhiloWords")
+		}
+		wordsFile += ".gz"
+	}
+	file, err := os.Open(wordsFile)
+	checkErr(err, "loadPhiloWords")
+	defer file.Close()
+	var input io.Reader = file
+	if strings.HasSuffix(wordsFile, ".gz") {
+		input, err = gzip.NewReader(file)
+		checkErr(err, "loadPhiloWords")
+	}
+	words := &philoWords{}
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		word := philoWord{}
+		if err := json.Unmarshal(scanner.Bytes(), &word); err != nil || word.Position == "" {
+			continue
+		}
+		words.startBytes = append(words.startBytes, word.StartByte)
+		words.philoIDs = append(words.philoIDs, strings.Fields(word.Position))
+	}
+	checkErr(scanner.Err(), "loadPhiloWords")
+	sort.Sort(words)
+	return words
+}
+
+func (words *philoWords) Len() int { return len(words.startBytes) }
+func (words *philoWords) Less(i, j int) bool {
+	return words.startBytes[i] < words.startBytes[j]
+}
+func (words *philoWords) Swap(i, j int) {
+	words.startBytes[i], words.startBytes[j] = words.startBytes[j], words.startBytes[i]
+	words.philoIDs[i], words.philoIDs[j] = words.philoIDs[j], words.philoIDs[i]
+}
+
+// wordAt returns the philo_id of the word starting at or right before rawByte
+func (words *philoWords) wordAt(rawByte int64) []string {
+	index := sort.Search(len(words.startBytes), func(i int) bool { return words.startBytes[i] > rawByte }) - 1
+	if index < 0 {
+		if len(words.philoIDs) == 0 {
+			return []string{}
+		}
+		index = 0
+	}
+	return words.philoIDs[index]
+}
+
+// objectID truncates a word philo_id to the object at depth: trailing zeros are dropped
+// for divs since a passage may sit in a div1 without any div2 or div3
+func objectID(wordID []string, depth int) string {
+	if len(wordID) < depth {
+		return ""
+	}
+	objectID := wordID[:depth]
+	if depth == philoDivDepth {
+		for len(objectID) > 2 && objectID[len(objectID)-1] == "0" {
+			objectID = objectID[:len(objectID)-1]
+		}
+	}
+	return strings.Join(objectID, " ")
+}
+
+// philoLink fills a link template with the link to the PhiloLogic database and a philo_id
+func philoLink(linkTemplate string, dbLink string, philoID string) string {
+	if dbLink == "" || philoID == "" {
+		return ""
+	}
+	link := strings.Replace(linkTemplate, "{db_link}", strings.TrimSuffix(dbLink, "/"), -1)
+	return strings.Replace(link, "{philo_id}", strings.Replace(philoID, " ", "/", -1), -1)
+}
+
+// addPhiloFields stores the philo_ids of the div, paragraph and sentence containing the passage boundaries,
+// along with a link to the paragraph where the passage starts
+func addPhiloFields(fields map[string]string, prefix string, words *philoWords, passagePosition *position, linkTemplate string, dbLink string) {
+	startWord := words.wordAt(passagePosition.startByte)
+	endWord := words.wordAt(passagePosition.endByte - 1)
+	fields[prefix+"start_div_philo_id"] = objectID(startWord, philoDivDepth)
+	fields[prefix+"start_para_philo_id"] = objectID(startWord, philoParaDepth)
+	fields[prefix+"start_sent_philo_id"] = objectID(startWord, philoSentDepth)
+	fields[prefix+"end_div_philo_id"] = objectID(endWord, philoDivDepth)
+	fields[prefix+"end_para_philo_id"] = objectID(endWord, philoParaDepth)
+	fields[prefix+"end_sent_philo_id"] = objectID(endWord, philoSentDepth)
+	linkedObject := fields[prefix+"start_para_philo_id"]
+	if strings.HasSuffix(linkedObject, " 0") { // no paragraph in this div
+		linkedObject = fields[prefix+"start_div_philo_id"]
+	}
+	fields[prefix+"passage_link"] = philoLink(linkTemplate, dbLink, linkedObject)
+}
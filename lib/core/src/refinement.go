@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// textToken is a word of a cleaned text with its position in the cleaned text
+type textToken struct {
+	text  string
+	start int
+	end   int
+}
+
+// tokensBetween splits the cleaned text between start and end into lowercased word tokens
+func (doc *cleanedText) tokensBetween(start int, end int) []textToken {
+	var tokens []textToken
+	tokenStart := -1
+	for position := start; position < end; {
+		char, width := utf8.DecodeRune(doc.text[position:])
+		if isWordRune(char) {
+			if tokenStart == -1 {
+				tokenStart = position
+			}
+		} else if tokenStart != -1 {
+			tokens = append(tokens, textToken{strings.ToLower(string(doc.text[tokenStart:position])), tokenStart, position})
+			tokenStart = -1
+		}
+		position += width
+	}
+	if tokenStart != -1 {
+		tokens = append(tokens, textToken{strings.ToLower(string(doc.text[tokenStart:end])), tokenStart, end})
+	}
+	return tokens
+}
+
+// passageTokens holds the tokens of a passage along with the tokens surrounding it
+type passageTokens struct {
+	before  []textToken
+	passage []textToken
+	after   []textToken
+}
+
+func getPassageTokens(doc *cleanedText, passagePosition *position, window int) passageTokens {
+	start, end := doc.cleanRange(passagePosition.startByte, passagePosition.endByte)
+	return passageTokens{
+		doc.tokensBetween(doc.tokensBefore(start, window), start),
+		doc.tokensBetween(start, end),
+		doc.tokensBetween(end, doc.tokensAfter(end, window)),
+	}
+}
+
+// refineBoundaries compares source and target tokens around the edges of each alignment: edges are first trimmed
+// to the closest pair of matching tokens, then extended as long as the surrounding tokens are identical.
+// Tokens are looked for within refinementWindow tokens of each edge. Ngram indexes are moved along with refined edges,
+// using the ngramOffsets of both docs, so that later steps read the ngrams of refined passages.
+func refineBoundaries(alignments []Alignment, sourceOffsets []indexedNgram, targetOffsets []indexedNgram, sourceFilename string, targetFilename string, config *matchingParams) {
+	sourceDoc := documentTexts.get(sourceFilename, config.sourceEncoding)
+	targetDoc := documentTexts.get(targetFilename, config.targetEncoding)
+	for index := range alignments {
+		alignment := &alignments[index]
+		source := getPassageTokens(sourceDoc, &alignment.source, config.refinementWindow)
+		target := getPassageTokens(targetDoc, &alignment.target, config.refinementWindow)
+		if len(source.passage) < 2 || len(target.passage) < 2 {
+			continue
+		}
+		sourceEdges := [2]int{source.passage[0].start, source.passage[len(source.passage)-1].end}
+		targetEdges := [2]int{target.passage[0].start, target.passage[len(target.passage)-1].end}
+		sourceTrim, targetTrim, found := firstMatchingPair(source.passage, target.passage, config.refinementWindow)
+		if !found {
+			continue
+		}
+		source.before = append(source.before, source.passage[:sourceTrim]...)
+		source.passage = source.passage[sourceTrim:]
+		target.before = append(target.before, target.passage[:targetTrim]...)
+		target.passage = target.passage[targetTrim:]
+		for len(source.before) > 0 && len(target.before) > 0 && source.before[len(source.before)-1].text == target.before[len(target.before)-1].text {
+			source.passage = append([]textToken{source.before[len(source.before)-1]}, source.passage...)
+			source.before = source.before[:len(source.before)-1]
+			target.passage = append([]textToken{target.before[len(target.before)-1]}, target.passage...)
+			target.before = target.before[:len(target.before)-1]
+		}
+
+		sourceTrim, targetTrim, found = firstMatchingPair(reverseTokens(source.passage), reverseTokens(target.passage), config.refinementWindow)
+		if found {
+			source.after = append(append([]textToken{}, source.passage[len(source.passage)-sourceTrim:]...), source.after...)
+			source.passage = source.passage[:len(source.passage)-sourceTrim]
+			target.after = append(append([]textToken{}, target.passage[len(target.passage)-targetTrim:]...), target.after...)
+			target.passage = target.passage[:len(target.passage)-targetTrim]
+			for len(source.after) > 0 && len(target.after) > 0 && source.after[0].text == target.after[0].text {
+				source.passage = append(source.passage, source.after[0])
+				source.after = source.after[1:]
+				target.passage = append(target.passage, target.after[0])
+				target.after = target.after[1:]
+			}
+		}
+
+		if refineEdges(&alignment.source, sourceDoc, sourceEdges, source.passage) {
+			refineNgramIndexes(&alignment.source, sourceOffsets)
+			alignment.refined = true
+		}
+		if refineEdges(&alignment.target, targetDoc, targetEdges, target.passage) {
+			refineNgramIndexes(&alignment.target, targetOffsets)
+			alignment.refined = true
+		}
+	}
+}
+
+// ngramOffsets lists the ngrams of a document in text order with their byte offsets
+func ngramOffsets(doc *docIndex) []indexedNgram {
+	offsets := []indexedNgram{}
+	for _, occurrences := range doc.Ngrams {
+		offsets = append(offsets, occurrences...)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i].index < offsets[j].index })
+	return offsets
+}
+
+// refineNgramIndexes sets the ngram indexes of a passage to the first and last ngrams found within its byte offsets.
+// Indexes are left unchanged when no ngram fits within the refined passage.
+func refineNgramIndexes(passagePosition *position, offsets []indexedNgram) {
+	first := sort.Search(len(offsets), func(i int) bool { return offsets[i].startByte >= passagePosition.startByte })
+	last := sort.Search(len(offsets), func(i int) bool { return offsets[i].endByte > passagePosition.endByte }) - 1
+	if first >= len(offsets) || last < first {
+		return
+	}
+	passagePosition.startNgramIndex = offsets[first].index
+	passagePosition.endNgramIndex = offsets[last].index
+}
+
+// refineEdges moves the edges of a passage to its refined tokens: edges whose token didn't change keep their original offset
+func refineEdges(passagePosition *position, doc *cleanedText, originalEdges [2]int, refinedTokens []textToken) bool {
+	refined := false
+	if start := refinedTokens[0].start; start != originalEdges[0] {
+		passagePosition.startByte = doc.rawOffset(start)
+		refined = true
+	}
+	if end := refinedTokens[len(refinedTokens)-1].end; end != originalEdges[1] {
+		passagePosition.endByte = doc.rawOffset(end)
+		refined = true
+	}
+	return refined
+}
+
+// firstMatchingPair finds the pair of positions closest to the start of both token lists where two consecutive tokens match
+func firstMatchingPair(sourceTokens []textToken, targetTokens []textToken, window int) (int, int, bool) {
+	for distance := 0; distance <= 2*window; distance++ {
+		for sourceIndex := 0; sourceIndex <= distance && sourceIndex <= window; sourceIndex++ {
+			targetIndex := distance - sourceIndex
+			if targetIndex > window || sourceIndex+1 >= len(sourceTokens) || targetIndex+1 >= len(targetTokens) {
+				continue
+			}
+			if sourceTokens[sourceIndex].text == targetTokens[targetIndex].text && sourceTokens[sourceIndex+1].text == targetTokens[targetIndex+1].text {
+				return sourceIndex, targetIndex, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func reverseTokens(tokens []textToken) []textToken {
+	reversed := make([]textToken, len(tokens))
+	for index, token := range tokens {
+		reversed[len(tokens)-1-index] = token
+	}
+	return reversed
+}
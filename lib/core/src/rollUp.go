@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PhiloLogic object levels and the number of philo_id components identifying them
+var philoObjectDepths = map[string]int{"doc": 1, "div1": 2, "div2": 3, "div3": 4, "para": 5, "sent": 6}
+
+// parentPairGroup aggregates all alignments between a pair of parent objects
+type parentPairGroup struct {
+	Level              string   `json:"level"`
+	SourceParentID     string   `json:"source_parent_id"`
+	TargetParentID     string   `json:"target_parent_id"`
+	SourceTitle        string   `json:"source_title"`
+	SourceAuthor       string   `json:"source_author"`
+	TargetTitle        string   `json:"target_title"`
+	TargetAuthor       string   `json:"target_author"`
+	AlignmentCount     int      `json:"alignment_count"`
+	SourceAlignedBytes int64    `json:"source_aligned_bytes"`
+	TargetAlignedBytes int64    `json:"target_aligned_bytes"`
+	PassageIDs         []string `json:"passage_ids"`
+	sourceRanges       map[string][][2]int64
+	targetRanges       map[string][][2]int64
+}
+
+// parentID returns the ID of the parent of an aligned text object at level. Levels are either
+// PhiloLogic object levels, resolved by truncating the philo_id, or metadata fields holding the parent ID.
+func parentID(fields map[string]string, prefix string, level string) string {
+	if depth, ok := philoObjectDepths[level]; ok {
+		if philoID := strings.Fields(fields[prefix+"philo_id"]); len(philoID) > 0 {
+			if len(philoID) > depth {
+				philoID = philoID[:depth]
+			}
+			return strings.Join(philoID, "_")
+		}
+		if level == "doc" {
+			return strings.Split(fields[prefix+"doc_id"], "_")[0]
+		}
+	}
+	return fields[prefix+level]
+}
+
+// rollUpAlignments aggregates alignments between text objects into alignments between their parents
+// for each of the levels requested. Results are written to one file per level.
+func rollUpAlignments(config *matchingParams) {
+	levels := []string{}
+	for _, level := range strings.Split(config.rollupLevels, ",") {
+		if level = strings.TrimSpace(level); level != "" {
+			levels = append(levels, level)
+		}
+	}
+	if len(levels) == 0 {
+		return
+	}
+	fmt.Printf("Rolling up alignments to %s level...", strings.Join(levels, ", "))
+	file, err := os.Open(filepath.Join(config.outputPath, "alignment.results"))
+	checkErr(err, "rollUpAlignments")
+	defer file.Close()
+
+	groups := make(map[string]map[[2]string]*parentPairGroup)
+	for _, level := range levels {
+		groups[level] = make(map[[2]string]*parentPairGroup)
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		fields := make(map[string]string)
+		json.Unmarshal([]byte(line), &fields)
+		sourceStart, _ := strconv.ParseInt(fields["source_start_byte"], 10, 64)
+		sourceEnd, _ := strconv.ParseInt(fields["source_end_byte"], 10, 64)
+		targetStart, _ := strconv.ParseInt(fields["target_start_byte"], 10, 64)
+		targetEnd, _ := strconv.ParseInt(fields["target_end_byte"], 10, 64)
+		for _, level := range levels {
+			pair := [2]string{parentID(fields, "source_", level), parentID(fields, "target_", level)}
+			if pair[0] == "" || pair[1] == "" {
+				continue
+			}
+			group, ok := groups[level][pair]
+			if !ok {
+				group = &parentPairGroup{Level: level, SourceParentID: pair[0], TargetParentID: pair[1],
+					SourceTitle: fields["source_title"], SourceAuthor: fields["source_author"],
+					TargetTitle: fields["target_title"], TargetAuthor: fields["target_author"],
+					PassageIDs: []string{}, sourceRanges: make(map[string][][2]int64), targetRanges: make(map[string][][2]int64)}
+				groups[level][pair] = group
+			}
+			group.AlignmentCount++
+			group.PassageIDs = append(group.PassageIDs, fields["passage_id"])
+			group.sourceRanges[fields["source_doc_id"]] = append(group.sourceRanges[fields["source_doc_id"]], [2]int64{sourceStart, sourceEnd})
+			group.targetRanges[fields["target_doc_id"]] = append(group.targetRanges[fields["target_doc_id"]], [2]int64{targetStart, targetEnd})
+		}
+	}
+
+	for _, level := range levels {
+		output, err := os.Create(filepath.Join(config.outputPath, fmt.Sprintf("alignment_rollup_%s.results", level)))
+		checkErr(err, "rollUpAlignments")
+		sortedGroups := make([]*parentPairGroup, 0, len(groups[level]))
+		for _, group := range groups[level] {
+			group.SourceAlignedBytes = coveredBytes(group.sourceRanges)
+			group.TargetAlignedBytes = coveredBytes(group.targetRanges)
+			sortedGroups = append(sortedGroups, group)
+		}
+		sort.Slice(sortedGroups, func(i, j int) bool {
+			if sortedGroups[i].AlignmentCount != sortedGroups[j].AlignmentCount {
+				return sortedGroups[i].AlignmentCount > sortedGroups[j].AlignmentCount
+			}
+			return sortedGroups[i].SourceParentID+"\t"+sortedGroups[i].TargetParentID < sortedGroups[j].SourceParentID+"\t"+sortedGroups[j].TargetParentID
+		})
+		for _, group := range sortedGroups {
+			jsonString, _ := json.Marshal(group)
+			jsonString = append(jsonString, "\n"...)
+			output.Write(jsonString)
+		}
+		output.Sync()
+		output.Close()
+	}
+	fmt.Println(" done.")
+}
+
+// coveredBytes returns the number of bytes covered by byte ranges, counting overlapping passages once
+func coveredBytes(rangesPerDoc map[string][][2]int64) int64 {
+	var total int64
+	for _, ranges := range rangesPerDoc {
+		sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+		currentStart, currentEnd := ranges[0][0], ranges[0][1]
+		for _, byteRange := range ranges[1:] {
+			if byteRange[0] > currentEnd {
+				total += currentEnd - currentStart
+				currentStart, currentEnd = byteRange[0], byteRange[1]
+			} else if byteRange[1] > currentEnd {
+				currentEnd = byteRange[1]
+			}
+		}
+		total += currentEnd - currentStart
+	}
+	return total
+}
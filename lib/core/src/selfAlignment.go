@@ -0,0 +1,24 @@
+package main
+
+// selfMatches keeps matches of a document with itself whose target follows the source by at least minDistance ngrams:
+// this drops the trivial diagonal and overlapping windows, and reports each repetition once, from its first occurrence
+func selfMatches(matches []ngramMatch, minDistance int64) []ngramMatch {
+	repeatedMatches := make([]ngramMatch, 0, len(matches))
+	for _, match := range matches {
+		if match.target.index-match.source.index >= minDistance {
+			repeatedMatches = append(repeatedMatches, match)
+		}
+	}
+	return repeatedMatches
+}
+
+// dropSelfOverlaps removes passages of a document aligned with itself whose source and target overlap
+func dropSelfOverlaps(alignments []Alignment) []Alignment {
+	repeatedPassages := make([]Alignment, 0, len(alignments))
+	for _, alignment := range alignments {
+		if !overlaps(&alignment.source, &alignment.target) {
+			repeatedPassages = append(repeatedPassages, alignment)
+		}
+	}
+	return repeatedPassages
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+)
+
+// corpusStats holds the frequency of every ngram across source and target files
+type corpusStats struct {
+	collectionFrequency map[int64]int64 // number of occurrences of each ngram
+	documentFrequency   map[int64]int64 // number of documents containing each ngram
+	totalNgrams         int64
+	totalDocs           int64
+}
+
+var corpusNgrams *corpusStats
+
+// computeCorpusStats reads all source and target files, batch by batch, to count ngram frequencies.
+// This is an extra pass over the corpus before alignment, and counts are kept for every distinct ngram.
+func computeCorpusStats(sourceFiles []sortedFile, targetFiles []sortedFile, config *matchingParams) *corpusStats {
+	stats := &corpusStats{make(map[int64]int64), make(map[int64]int64), 0, 0}
+	for side, files := range [][]sortedFile{sourceFiles, targetFiles} {
+		if len(files) == 0 {
+			continue
+		}
+		batches := config.sourceBatch
+		if side == 1 {
+			batches = config.targetBatch
+		}
+		if batches > len(files) {
+			batches = len(files)
+		}
+		for _, batch := range makeSliceOfSlices(files, batches) {
+			docs := getJSONDocs(batch, "Computing corpus ngram frequencies", config.numThreads)
+			if translations != nil && side == 0 {
+				translations.rekeySourceDocs(docs)
+			} else if translations != nil {
+				translations.rekeyTargetDocs(docs)
+			} else if fuzzyNgrams != nil { // count variants under the derived key they are matched on
+				for docPosition := range docs {
+					fuzzyNgrams.rekey(&docs[docPosition])
+				}
+			}
+			for _, doc := range docs {
+				for ngram, occurrences := range doc.Ngrams {
+					stats.collectionFrequency[ngram] += int64(len(occurrences))
+					stats.documentFrequency[ngram]++
+					stats.totalNgrams += int64(len(occurrences))
+				}
+				stats.totalDocs++
+			}
+		}
+	}
+	return stats
+}
+
+// ngramsByPosition returns the ngram found at each position of a document, -1 where none is indexed
+func ngramsByPosition(doc *docIndex) []int64 {
+	var lastPosition int64 = -1
+	for _, occurrences := range doc.Ngrams {
+		for _, occurrence := range occurrences {
+			if occurrence.index > lastPosition {
+				lastPosition = occurrence.index
+			}
+		}
+	}
+	positions := make([]int64, lastPosition+1)
+	for index := range positions {
+		positions[index] = -1
+	}
+	for ngram, occurrences := range doc.Ngrams {
+		for _, occurrence := range occurrences {
+			positions[occurrence.index] = ngram
+		}
+	}
+	return positions
+}
+
+// logPoissonTail returns the natural log of the probability of observing at least k events
+// when lambda are expected
+func logPoissonTail(k int64, lambda float64) float64 {
+	if k <= 0 {
+		return 0
+	}
+	if lambda <= 0 {
+		return math.Inf(-1)
+	}
+	if float64(k) <= lambda { // the tail holds most of the distribution: subtract the head
+		term, head := math.Exp(-lambda), 0.0
+		for j := int64(0); j < k; j++ {
+			head += term
+			term *= lambda / float64(j+1)
+		}
+		return math.Log(math.Max(1-head, math.SmallestNonzeroFloat64))
+	}
+	logFactorial, _ := math.Lgamma(float64(k + 1))
+	logFirstTerm := -lambda + float64(k)*math.Log(lambda) - logFactorial
+	sum, ratio := 1.0, 1.0
+	for j := k + 1; ratio > 1e-12*sum; j++ {
+		ratio *= lambda / float64(j)
+		sum += ratio
+	}
+	return logFirstTerm + math.Log(sum)
+}
+
+// significance computes the probability of finding by chance as many matching ngrams as an alignment holds:
+// each source ngram of the passage is expected to occur in a target span of the same length with a probability
+// given by its corpus frequency, and the number of chance matches follows a Poisson distribution.
+// The score is the negative base 10 log of this p-value.
+func significance(alignment *Alignment, sourcePositions []int64) (float64, float64) {
+	targetSpan := float64(alignment.target.endNgramIndex - alignment.target.startNgramIndex + 1)
+	totalNgrams := float64(corpusNgrams.totalNgrams)
+	lambda := 0.0
+	for index := alignment.source.startNgramIndex; index <= alignment.source.endNgramIndex && index < int64(len(sourcePositions)); index++ {
+		frequency := int64(1)
+		if ngram := sourcePositions[index]; ngram != -1 {
+			frequency = corpusNgrams.collectionFrequency[ngram]
+		}
+		lambda += math.Min(1, float64(frequency)/totalNgrams*targetSpan)
+	}
+	logPValue := logPoissonTail(alignment.totalMatchingNgrams, lambda)
+	return math.Exp(logPValue), -logPValue / math.Ln10
+}
+
+// scoreSignificance sets the p-value and significance score of alignments, and dismisses
+// those above the maximum p-value or below the minimum significance score
+func scoreSignificance(alignments []Alignment, sourcePositions []int64, config *matchingParams) []Alignment {
+	significantAlignments := make([]Alignment, 0, len(alignments))
+	for _, alignment := range alignments {
+		alignment.pValue, alignment.significance = significance(&alignment, sourcePositions)
+		if (config.maxPValue > 0 && alignment.pValue > config.maxPValue) || alignment.significance < config.minimumSignificance {
+			continue
+		}
+		significantAlignments = append(significantAlignments, alignment)
+	}
+	return significantAlignments
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLogPoissonTail(t *testing.T) {
+	tests := []struct {
+		k        int64
+		lambda   float64
+		expected float64
+	}{
+		{0, 2, 0},
+		{1, 1, -0.4586751453870821},
+		{3, 1, -2.5219682600314},
+		{5, 2, -2.944031732572082},
+		{10, 10, -0.6123596078537518},
+		{20, 0.5, -56.674489444928724},
+		{50, 3, -96.48660265158423},
+	}
+	for _, test := range tests {
+		if got := logPoissonTail(test.k, test.lambda); math.Abs(got-test.expected) > 1e-9*math.Max(1, math.Abs(test.expected)) {
+			t.Errorf("logPoissonTail(%d, %g): expected %g, got %g", test.k, test.lambda, test.expected, got)
+		}
+	}
+	if got := logPoissonTail(3, 0); !math.IsInf(got, -1) {
+		t.Errorf("logPoissonTail(3, 0): expected -Inf, got %g", got)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// textStore holds cleaned versions of the documents we extract passages from.
+// Each file is read and cleaned once, then passages and contexts are sliced from memory.
+// The number of documents kept in memory is bounded: least recently used documents are evicted first.
+type textStore struct {
+	cache    *lruCache
+	cleaning cleaningOptions
+}
+
+// lruCache is a thread-safe cache of per document data which evicts least recently used entries
+type lruCache struct {
+	mutex   sync.Mutex
+	maxSize int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	key   string
+	value interface{}
+}
+
+// cleaningOptions define which content is dropped when cleaning texts and what is kept of the markup
+type cleaningOptions struct {
+	excludedElements map[string]bool // elements whose content is dropped, such as notes or page furniture
+	placeholder      string          // text standing in for the dropped content of an excluded element
+	citations        bool            // keep the structural markers used to build citations
+}
+
+// cleanedText is a document stripped of tags and entities and converted to UTF-8, along with
+// the raw byte offset each byte of the cleaned text originates from. All the bytes of a character
+// share the offset of the first raw byte of that character, so raw offsets always map to rune boundaries.
+// Raw offsets are stored as runs of characters rather than one offset per cleaned byte, which would take
+// eight times the size of the text in memory.
+type cleanedText struct {
+	filename   string
+	text       []byte
+	offsetRuns []offsetRun
+	rawLength  int64
+	// offsets in the cleaned text where block-level elements such as paragraphs open or close
+	paragraphBreaks []int
+	// page breaks, line breaks, divs and other markers used to build citations, sorted by raw offset
+	markers []structuralMarker
+	// locator in effect after each marker, built the first time a citation is requested
+	locators     []citationLocator
+	locatorsOnce sync.Once
+}
+
+// Elements which delimit paragraphs when extracting context by paragraph or sentence
+var paragraphElements = map[string]bool{
+	"p": true, "div": true, "div1": true, "div2": true, "div3": true, "div4": true, "div5": true, "div6": true, "div7": true,
+	"lg": true, "ab": true, "head": true, "sp": true, "list": true, "item": true, "table": true, "row": true,
+	"body": true, "front": true, "back": true, "text": true, "opener": true, "closer": true, "argument": true,
+	"epigraph": true, "byline": true, "titlepage": true,
+}
+
+// xmlTag is the parsed representation of a tag found in the raw text
+type xmlTag struct {
+	name        string
+	end         bool
+	selfClosing bool
+	attributes  []byte
+}
+
+func parseTag(tag []byte) xmlTag {
+	parsedTag := xmlTag{}
+	tag = bytes.TrimPrefix(bytes.TrimSuffix(tag, []byte(">")), []byte("<"))
+	if bytes.HasPrefix(tag, []byte("/")) {
+		parsedTag.end = true
+		tag = tag[1:]
+	}
+	if bytes.HasSuffix(tag, []byte("/")) {
+		parsedTag.selfClosing = true
+		tag = tag[:len(tag)-1]
+	}
+	nameEnd := bytes.IndexAny(tag, " \t\r\n/")
+	if nameEnd == -1 {
+		nameEnd = len(tag)
+	}
+	parsedTag.name = strings.ToLower(string(tag[:nameEnd]))
+	parsedTag.attributes = tag[nameEnd:]
+	return parsedTag
+}
+
+// offsetRun is a run of consecutive cleaned characters of the same width in bytes whose raw offsets
+// are evenly spaced: character n of the run starts at rawStart + n*rawStep in the raw file
+type offsetRun struct {
+	cleanStart int
+	rawStart   int64
+	rawStep    int32
+	cleanWidth int32
+	chars      int32
+}
+
+// rawEnd returns the raw offset of the last character of a run
+func (run *offsetRun) rawEnd() int64 {
+	return run.rawStart + int64(run.chars-1)*int64(run.rawStep)
+}
+
+// addOffset records the raw offset of a character about to be appended to the cleaned text
+func (doc *cleanedText) addOffset(rawOffset int64, cleanWidth int) {
+	if runs := len(doc.offsetRuns); runs > 0 {
+		run := &doc.offsetRuns[runs-1]
+		step := rawOffset - run.rawEnd()
+		if int(run.cleanWidth) == cleanWidth && step <= math.MaxInt32 && (run.chars == 1 || step == int64(run.rawStep)) {
+			run.rawStep = int32(step)
+			run.chars++
+			return
+		}
+	}
+	doc.offsetRuns = append(doc.offsetRuns, offsetRun{len(doc.text), rawOffset, 0, int32(cleanWidth), 1})
+}
+
+// rawOffset returns the raw byte offset of a position in the cleaned text. When used for the end of a token,
+// this is the offset of the next cleaned character, so any tag following the token is included.
+func (doc *cleanedText) rawOffset(position int) int64 {
+	if position >= len(doc.text) {
+		return doc.rawLength
+	}
+	runIndex := sort.Search(len(doc.offsetRuns), func(i int) bool { return doc.offsetRuns[i].cleanStart > position }) - 1
+	run := &doc.offsetRuns[runIndex]
+	return run.rawStart + int64((position-run.cleanStart)/int(run.cleanWidth))*int64(run.rawStep)
+}
+
+var documentTexts *textStore
+
+func newTextStore(maxDocs int, cleaning cleaningOptions) *textStore {
+	return &textStore{newLRUCache(maxDocs), cleaning}
+}
+
+func newLRUCache(maxSize int) *lruCache {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	return &lruCache{maxSize: maxSize, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// getOrLoad returns the cached value for key, calling load to build it if it isn't cached
+func (cache *lruCache) getOrLoad(key string, load func() interface{}) interface{} {
+	cache.mutex.Lock()
+	if element, ok := cache.entries[key]; ok {
+		cache.lru.MoveToFront(element)
+		cache.mutex.Unlock()
+		return element.Value.(*cacheEntry).value
+	}
+	cache.mutex.Unlock()
+
+	value := load() // loaded outside of the lock so other entries can be served meanwhile
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if element, ok := cache.entries[key]; ok { // another goroutine loaded it first
+		cache.lru.MoveToFront(element)
+		return element.Value.(*cacheEntry).value
+	}
+	cache.entries[key] = cache.lru.PushFront(&cacheEntry{key, value})
+	for cache.lru.Len() > cache.maxSize {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).key)
+	}
+	return value
+}
+
+// parseElementList turns a comma separated list of element names into a set
+func parseElementList(elements string) map[string]bool {
+	elementSet := make(map[string]bool)
+	for _, element := range strings.Split(elements, ",") {
+		if element = strings.ToLower(strings.TrimSpace(element)); element != "" {
+			elementSet[element] = true
+		}
+	}
+	return elementSet
+}
+
+// get returns the cleaned text of filename, loading it if it isn't cached
+func (store *textStore) get(filename string, encoding string) *cleanedText {
+	return store.cache.getOrLoad(filename, func() interface{} {
+		return loadCleanedText(filename, encoding, store.cleaning)
+	}).(*cleanedText)
+}
+
+// passage returns the cleaned text found between startByte and endByte in the raw file
+func (store *textStore) passage(filename string, encoding string, startByte int64, endByte int64) string {
+	doc := store.get(filename, encoding)
+	start, end := doc.cleanRange(startByte, endByte)
+	return doc.slice(start, end)
+}
+
+// slice returns the cleaned text between two cleaned offsets as valid UTF-8
+func (doc *cleanedText) slice(start int, end int) string {
+	passage := doc.text[start:end]
+	if !utf8.Valid(passage) {
+		return strings.ToValidUTF8(string(passage), "\uFFFD")
+	}
+	return string(passage)
+}
+
+// cleanOffset maps a raw byte offset to the offset of the first cleaned byte at or after it
+func (doc *cleanedText) cleanOffset(rawByte int64) int {
+	runIndex := sort.Search(len(doc.offsetRuns), func(i int) bool { return doc.offsetRuns[i].rawEnd() >= rawByte })
+	if runIndex == len(doc.offsetRuns) {
+		return len(doc.text)
+	}
+	run := &doc.offsetRuns[runIndex]
+	if rawByte <= run.rawStart || run.rawStep == 0 {
+		return run.cleanStart
+	}
+	char := (rawByte - run.rawStart + int64(run.rawStep) - 1) / int64(run.rawStep)
+	return run.cleanStart + int(char)*int(run.cleanWidth)
+}
+
+func (doc *cleanedText) cleanRange(startByte int64, endByte int64) (int, int) {
+	if startByte < 0 {
+		startByte = 0
+	}
+	if endByte > doc.rawLength {
+		endByte = doc.rawLength
+	}
+	start, end := doc.cleanOffset(startByte), doc.cleanOffset(endByte)
+	if end < start {
+		end = start
+	}
+	return start, end
+}
+
+func loadCleanedText(filename string, encoding string, cleaning cleaningOptions) *cleanedText {
+	raw, err := ioutil.ReadFile(filename)
+	checkErr(err, "loadCleanedText (opening "+filename+")")
+	decodeRune, err := getRuneDecoder(encoding)
+	checkErr(err, "loadCleanedText")
+	doc := &cleanedText{filename: filename, rawLength: int64(len(raw))}
+	doc.clean(raw, decodeRune, cleaning)
+	return doc
+}
+
+// clean strips tags, decodes entities, converts characters to UTF-8 and collapses whitespace
+// in a single pass while recording where each cleaned byte comes from in the raw file.
+// The content of excluded elements is dropped, and replaced by the placeholder if there is one.
+func (doc *cleanedText) clean(raw []byte, decodeRune runeDecoder, cleaning cleaningOptions) {
+	doc.text = make([]byte, 0, len(raw))
+	previousSpace := false
+	excludedElement := ""
+	excludedDepth := 0
+	var encodedChar [utf8.UTFMax]byte
+	addChar := func(offset int, char rune) {
+		if excludedDepth > 0 {
+			return
+		}
+		switch char {
+		case ' ', '\t', '\n', '\r', '\u00a0':
+			if !previousSpace {
+				doc.addOffset(int64(offset), 1)
+				doc.text = append(doc.text, ' ')
+				previousSpace = true
+			}
+		case 0:
+		default:
+			width := utf8.EncodeRune(encodedChar[:], char)
+			doc.addOffset(int64(offset), width)
+			doc.text = append(doc.text, encodedChar[:width]...)
+			previousSpace = false
+		}
+	}
+	for i := 0; i < len(raw); {
+		switch {
+		case raw[i] == '<':
+			tagEnd := bytes.IndexByte(raw[i:], '>')
+			if tagEnd == -1 {
+				i = len(raw)
+				continue
+			}
+			tag := parseTag(raw[i : i+tagEnd+1])
+			if excludedDepth > 0 {
+				if tag.name == excludedElement && !tag.selfClosing { // track nested elements of the same name
+					if tag.end {
+						excludedDepth--
+					} else {
+						excludedDepth++
+					}
+				}
+			} else if cleaning.excludedElements[tag.name] && !tag.end && !tag.selfClosing {
+				if cleaning.placeholder != "" {
+					addChar(i, ' ')
+					for _, char := range cleaning.placeholder {
+						addChar(i, char)
+					}
+					addChar(i, ' ')
+				}
+				excludedElement = tag.name
+				excludedDepth = 1
+			} else {
+				if cleaning.citations && isStructuralElement(tag.name) {
+					doc.markers = append(doc.markers, newStructuralMarker(int64(i), tag))
+				}
+				if paragraphElements[tag.name] {
+					addChar(i, ' ') // keep words of adjacent blocks apart
+					if breaks := len(doc.paragraphBreaks); breaks == 0 || doc.paragraphBreaks[breaks-1] != len(doc.text) {
+						doc.paragraphBreaks = append(doc.paragraphBreaks, len(doc.text))
+					}
+				}
+			}
+			i += tagEnd + 1
+		case raw[i] == '&':
+			entityEnd := bytes.IndexByte(raw[i:], ';')
+			if entityEnd != -1 && entityEnd <= 32 {
+				entity := string(raw[i : i+entityEnd+1])
+				if unescaped := html.UnescapeString(entity); unescaped != entity {
+					for _, char := range unescaped {
+						addChar(i, char)
+					}
+					i += entityEnd + 1
+					continue
+				}
+			}
+			addChar(i, '&')
+			i++
+		case raw[i] == '\\' && i+1 < len(raw) && (raw[i+1] == 'n' || raw[i+1] == 't' || raw[i+1] == 'r'): // escaped whitespace
+			addChar(i, ' ')
+			i += 2
+		default:
+			char, width := decodeRune(raw[i:])
+			addChar(i, char)
+			i += width
+		}
+	}
+}
+
+// runeDecoder decodes the first character of a byte slice and returns it with its width in bytes
+type runeDecoder func([]byte) (rune, int)
+
+// Windows-1252 characters in the 0x80-0x9F range, which Latin-1 uses for control characters
+var windows1252Runes = [32]rune{
+	'€', utf8.RuneError, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', utf8.RuneError, 'Ž', utf8.RuneError,
+	utf8.RuneError, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', utf8.RuneError, 'ž', 'Ÿ',
+}
+
+func getRuneDecoder(encoding string) (runeDecoder, error) {
+	switch strings.Replace(strings.ToLower(encoding), "_", "-", -1) {
+	case "", "utf-8", "utf8":
+		return utf8.DecodeRune, nil
+	case "latin-1", "latin1", "iso-8859-1", "iso8859-1":
+		return func(raw []byte) (rune, int) { return rune(raw[0]), 1 }, nil
+	case "windows-1252", "cp1252":
+		return func(raw []byte) (rune, int) {
+			if raw[0] >= 0x80 && raw[0] < 0xa0 {
+				return windows1252Runes[raw[0]-0x80], 1
+			}
+			return rune(raw[0]), 1
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported input encoding %s: use utf-8, latin-1 or windows-1252", encoding)
+}
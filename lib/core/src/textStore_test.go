@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestCleanedTextOffsets(t *testing.T) {
+	decodeRune, _ := getRuneDecoder("utf-8")
+	tests := []struct {
+		raw     string
+		text    string
+		offsets []int64 // raw offset of each cleaned byte
+	}{
+		{"abc", "abc", []int64{0, 1, 2}},
+		{"a <hi>b</hi>c", "a bc", []int64{0, 1, 6, 12}},
+		{"a&amp;b", "a&b", []int64{0, 1, 6}},
+		{"é  b\n\nc", "é b c", []int64{0, 0, 2, 4, 5, 7}},
+		{"<p>ab</p><p>cd</p>", " ab cd ", []int64{0, 3, 4, 5, 12, 13, 14}},
+		{"x<note>n</note>y", "xy", []int64{0, 15}},
+	}
+	for _, test := range tests {
+		doc := &cleanedText{rawLength: int64(len(test.raw))}
+		doc.clean([]byte(test.raw), decodeRune, cleaningOptions{excludedElements: map[string]bool{"note": true}})
+		if string(doc.text) != test.text {
+			t.Errorf("%q: expected cleaned text %q, got %q", test.raw, test.text, doc.text)
+			continue
+		}
+		for position, offset := range test.offsets {
+			if got := doc.rawOffset(position); got != offset {
+				t.Errorf("%q: expected raw offset %d for cleaned byte %d, got %d", test.raw, offset, position, got)
+			}
+		}
+		for rawByte := int64(0); rawByte <= int64(len(test.raw)); rawByte++ {
+			expected := len(test.offsets)
+			for position, offset := range test.offsets {
+				if offset >= rawByte {
+					expected = position
+					break
+				}
+			}
+			if got := doc.cleanOffset(rawByte); got != expected {
+				t.Errorf("%q: expected cleaned offset %d for raw byte %d, got %d", test.raw, expected, rawByte, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Maximum number of translations of a source ngram: tokens with many translations multiply the combinations
+const maxTranslationsPerNgram = 16
+
+// translationIndex maps source ngrams to the keys of their possible translations and target ngrams to their own key.
+// Keys are built from sorted tokens so that word order within ngrams doesn't matter across languages. Reordering
+// across ngrams is left to the unordered matching mode.
+type translationIndex struct {
+	sourceKeys map[int64][]int64
+	targetKeys map[int64]int64
+	translated map[int64]bool // source ngrams with at least one token translated through the dictionary
+}
+
+var translations *translationIndex
+
+// loadDictionary reads a bilingual dictionary: each line holds a source token followed by its translations,
+// separated by tabs, commas or spaces. Lines starting with # are ignored.
+func loadDictionary(fileLocation string) map[string][]string {
+	file, err := os.Open(fileLocation)
+	checkErr(err, "loadDictionary")
+	defer file.Close()
+	dictionary := make(map[string][]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries := strings.FieldsFunc(strings.ToLower(line), func(char rune) bool { return char == ',' || unicode.IsSpace(char) })
+		if len(entries) < 2 {
+			continue
+		}
+		dictionary[entries[0]] = append(dictionary[entries[0]], entries[1:]...)
+	}
+	checkErr(scanner.Err(), "loadDictionary")
+	return dictionary
+}
+
+// orderFreeKey derives a key from the tokens of an ngram regardless of their order within the ngram
+func orderFreeKey(tokens []string) int64 {
+	sortedTokens := append([]string{}, tokens...)
+	sort.Strings(sortedTokens)
+	return fuzzyKey(strings.Join(sortedTokens, ngramTokenSeparator))
+}
+
+// translateNgram returns the possible translations of an ngram: tokens missing from the dictionary,
+// such as proper names, are kept as they are
+func translateNgram(tokens []string, dictionary map[string][]string) ([][]string, bool) {
+	translatedNgrams := [][]string{{}}
+	translated := false
+	for _, token := range tokens {
+		tokenTranslations, ok := dictionary[token]
+		if !ok {
+			tokenTranslations = []string{token}
+		} else {
+			translated = true
+		}
+		nextNgrams := [][]string{}
+		for _, ngram := range translatedNgrams {
+			for _, translation := range tokenTranslations {
+				if len(nextNgrams) == maxTranslationsPerNgram {
+					break
+				}
+				nextNgrams = append(nextNgrams, append(append([]string{}, ngram...), translation))
+			}
+		}
+		translatedNgrams = nextNgrams
+	}
+	return translatedNgrams, translated
+}
+
+// newTranslationIndex translates the ngrams of the source index through the dictionary and keeps
+// the translations found among target ngrams
+func newTranslationIndex(sourceIndex string, targetIndex string, dictionaryFile string) *translationIndex {
+	fmt.Printf("Translating source ngrams...")
+	dictionary := loadDictionary(dictionaryFile)
+	index := &translationIndex{make(map[int64][]int64), make(map[int64]int64), make(map[int64]bool)}
+	targetNgrams := make(map[int64]string)
+	readIndexedNgrams(targetIndex, targetNgrams)
+	keysInTarget := make(map[int64]bool, len(targetNgrams))
+	for hash, ngram := range targetNgrams {
+		key := orderFreeKey(strings.Split(ngram, ngramTokenSeparator))
+		index.targetKeys[hash] = key
+		keysInTarget[key] = true
+	}
+	sourceNgrams := make(map[int64]string)
+	readIndexedNgrams(sourceIndex, sourceNgrams)
+	for hash, ngram := range sourceNgrams {
+		translatedNgrams, translated := translateNgram(strings.Split(ngram, ngramTokenSeparator), dictionary)
+		for _, translatedNgram := range translatedNgrams {
+			if key := orderFreeKey(translatedNgram); keysInTarget[key] {
+				index.sourceKeys[hash] = append(index.sourceKeys[hash], key)
+			}
+		}
+		if translated && len(index.sourceKeys[hash]) > 0 {
+			index.translated[hash] = true
+		}
+	}
+	fmt.Printf(" %d source ngrams have a translation in target ngrams.\n", len(index.sourceKeys))
+	return index
+}
+
+// rekeyNgrams moves the ngrams of a doc to their keys, dropping those without any, and keeps track
+// of their original hash by ngram position
+func rekeyNgrams(doc *docIndex, keysOf func(hash int64) []int64) {
+	rekeyedNgrams := make(map[int64][]indexedNgram)
+	doc.Translations = make(map[int64]int64)
+	for hash, ngrams := range doc.Ngrams {
+		for _, key := range keysOf(hash) {
+			rekeyedNgrams[key] = append(rekeyedNgrams[key], ngrams...)
+		}
+		for _, ngram := range ngrams {
+			doc.Translations[ngram.index] = hash
+		}
+	}
+	doc.Ngrams = rekeyedNgrams
+	doc.NgramLength = len(rekeyedNgrams)
+}
+
+func (index *translationIndex) rekeySourceDocs(docs []docIndex) {
+	for docPosition := range docs {
+		rekeyNgrams(&docs[docPosition], func(hash int64) []int64 { return index.sourceKeys[hash] })
+	}
+}
+
+func (index *translationIndex) rekeyTargetDocs(docs []docIndex) {
+	for docPosition := range docs {
+		rekeyNgrams(&docs[docPosition], func(hash int64) []int64 {
+			if key, ok := index.targetKeys[hash]; ok {
+				return []int64{key}
+			}
+			return nil
+		})
+	}
+}
+
+// rekeyCommonNgrams adds the keys of common source and target ngrams to the list of common ngrams
+func (index *translationIndex) rekeyCommonNgrams(commonNgrams map[int64]bool) {
+	for hash := range commonNgrams {
+		for _, key := range index.sourceKeys[hash] {
+			commonNgrams[key] = true
+		}
+		if key, ok := index.targetKeys[hash]; ok {
+			commonNgrams[key] = true
+		}
+	}
+}
+
+// isTranslatedMatch checks whether the source ngram of a match was translated through the dictionary
+func isTranslatedMatch(sourceFile *docIndex, source indexedNgram) bool {
+	if translations == nil {
+		return false
+	}
+	return translations.translated[sourceFile.Translations[source.index]]
+}
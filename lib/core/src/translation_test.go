@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestGetMatchesOnTranslatedDocsWithoutFuzzyMatching(t *testing.T) {
+	fuzzyNgrams = nil
+	translations = &translationIndex{
+		sourceKeys: map[int64][]int64{1: {100}, 2: {200}},
+		targetKeys: map[int64]int64{11: 100, 12: 200},
+		translated: map[int64]bool{1: true},
+	}
+	defer func() { translations = nil }()
+	sourceDocs := []docIndex{{DocID: "source", Ngrams: map[int64][]indexedNgram{1: {{0, 0, 10}}, 2: {{1, 5, 15}}}}}
+	targetDocs := []docIndex{{DocID: "target", Ngrams: map[int64][]indexedNgram{11: {{0, 0, 12}}, 12: {{1, 6, 18}}}}}
+	translations.rekeySourceDocs(sourceDocs)
+	translations.rekeyTargetDocs(targetDocs)
+
+	matches := getMatches(&sourceDocs[0], &targetDocs[0], map[int64]int{100: 2, 200: 2})
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 matches, got %d", len(matches))
+	}
+	if !matches[0].translated || matches[1].translated {
+		t.Errorf("expected only the first match to be translated, got %v and %v", matches[0].translated, matches[1].translated)
+	}
+	for _, match := range matches {
+		if match.fuzzy || match.equivalent {
+			t.Errorf("translated match flagged as fuzzy or equivalent: %+v", match)
+		}
+	}
+	if len(sourceDocs[0].Variants) != 0 {
+		t.Errorf("translation keys recorded as fuzzy variants: %v", sourceDocs[0].Variants)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import "fmt"
+
+// Matching modes: monotonic requires target matches to follow each other, while unordered
+// accepts matches anywhere within the current target span, extended by the reorder tolerance
+var matchingModes = map[string]bool{"monotonic": true, "unordered": true}
+
+func checkMatchingMode(mode string) error {
+	if !matchingModes[mode] {
+		return fmt.Errorf("unknown matching mode %s: use monotonic or unordered", mode)
+	}
+	return nil
+}
+
+// matchPassageUnordered groups matches into passages regardless of the order of target matches: a match extends the
+// current passage when its source is within max_gap of the last source match and its target falls within the target
+// span of the passage, extended by max_gap after its end and reorder_tolerance before its start. As in monotonic mode,
+// every sliding window of matching_window_size source ngrams must hold minimum_matching_ngrams_in_window matches,
+// and a rare anchor when passages require them.
+func matchPassageUnordered(matches []ngramMatch, config *matchingParams) []Alignment {
+	alignments := make([]Alignment, 0)
+	var lastSourcePosition int64
+	for matchIndex, anchor := range matches {
+		if anchor.source.index < lastSourcePosition {
+			continue
+		}
+		m := &matchValues{}
+		m.firstMatch = []indexedNgram{anchor.source, anchor.target}
+		m.lastMatch = []indexedNgram{anchor.source, anchor.target}
+		countMatch(m, &anchor, config)
+		windowStart := anchor.source.index
+		m.matchesInCurrentWindow = 1
+		lastTarget := anchor.target.index
+		for _, match := range matches[matchIndex+1:] {
+			if match.source.index > m.lastMatch[0].index+config.maxGap {
+				break
+			}
+			if match.source.index == m.lastMatch[0].index || match.target.index < m.firstMatch[1].index-config.reorderTolerance ||
+				match.target.index > m.lastMatch[1].index+config.maxGap {
+				continue
+			}
+			if match.source.index > windowStart+config.matchingWindowSize {
+				if m.matchesInCurrentWindow < config.minimumMatchingNgramsInWindow || !windowHasRareAnchors(m, config) {
+					break
+				}
+				windowStart = match.source.index
+				m.matchesInCurrentWindow = 0
+				m.rareAnchorsInCurrentWindow = 0
+			}
+			m.lastMatch[0] = match.source
+			if match.target.index < m.firstMatch[1].index {
+				m.firstMatch[1] = match.target
+			}
+			if match.target.index > m.lastMatch[1].index {
+				m.lastMatch[1] = match.target
+			}
+			if match.target.index < lastTarget {
+				m.currentAlignment.reordered = true
+			}
+			lastTarget = match.target.index
+			m.matchesInCurrentWindow++
+			countMatch(m, &match, config)
+		}
+		if weightedMatches(m, config) >= float64(config.minimumMatchingNgrams) && hasRareAnchors(m, config) {
+			addAlignment(m, config, &alignments)
+			lastSourcePosition = m.lastMatch[0].index + 1
+		}
+	}
+	return alignments
+}
+
+// countMatch adds a match to the counts of the current alignment
+func countMatch(m *matchValues, match *ngramMatch, config *matchingParams) {
+	m.matchesInCurrentAlignment++
+	if match.fuzzy {
+		m.fuzzyMatches++
+	}
+	if match.equivalent {
+		m.equivalentMatches++
+	}
+	if match.translated {
+		m.translatedMatches++
+	}
+	countRareAnchor(m, match, config)
+}
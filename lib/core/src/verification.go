@@ -0,0 +1,104 @@
+package main
+
+// localAlignmentScores are the scores used by the Smith-Waterman local alignment of passage tokens
+type localAlignmentScores struct {
+	match    int64
+	mismatch int64
+	gap      int64
+}
+
+// localAlignmentCell holds the best score ending at a cell of the alignment matrix, along with
+// the number of identical tokens and the length of the local alignment leading to it
+type localAlignmentCell struct {
+	score   int64
+	matches int
+	length  int
+}
+
+// maxAlignmentCells caps the number of cells computed by the local alignment of two passages, so that
+// long passages don't take quadratic time
+const maxAlignmentCells = 4000000
+
+// localAlignment runs a Smith-Waterman alignment of two token sequences and returns the best score
+// along with the percentage of identical tokens in the best local alignment. Sequences too long for
+// maxAlignmentCells are aligned within a band around the diagonal of the alignment matrix.
+func localAlignment(sourceTokens []textToken, targetTokens []textToken, scores localAlignmentScores) (int64, float64) {
+	band := len(targetTokens)
+	if len(sourceTokens)*len(targetTokens) > maxAlignmentCells {
+		band = maxAlignmentCells / (2 * len(sourceTokens))
+		if band < 1 {
+			band = 1
+		}
+	}
+	previousRow := make([]localAlignmentCell, len(targetTokens)+1)
+	currentRow := make([]localAlignmentCell, len(targetTokens)+1)
+	var filledCells [2][2]int // cells of each row filled in by the band, cleared before the row is reused
+	best := localAlignmentCell{}
+	for i, sourceToken := range sourceTokens {
+		start, end := 0, len(targetTokens)
+		if band < len(targetTokens) {
+			center := i * len(targetTokens) / len(sourceTokens)
+			if center > band {
+				start = center - band
+			}
+			if center+band+1 < end {
+				end = center + band + 1
+			}
+		}
+		filled := &filledCells[i%2]
+		for j := filled[0]; j < filled[1]; j++ {
+			currentRow[j] = localAlignmentCell{}
+		}
+		filled[0], filled[1] = start+1, end+1
+		for j := start; j < end; j++ {
+			targetToken := targetTokens[j]
+			diagonal := previousRow[j]
+			diagonal.length++
+			if sourceToken.text == targetToken.text {
+				diagonal.score += scores.match
+				diagonal.matches++
+			} else {
+				diagonal.score += scores.mismatch
+			}
+			up := previousRow[j+1]
+			up.score += scores.gap
+			up.length++
+			left := currentRow[j]
+			left.score += scores.gap
+			left.length++
+			cell := localAlignmentCell{}
+			for _, candidate := range []localAlignmentCell{diagonal, up, left} {
+				if candidate.score > cell.score {
+					cell = candidate
+				}
+			}
+			currentRow[j+1] = cell
+			if cell.score > best.score {
+				best = cell
+			}
+		}
+		previousRow, currentRow = currentRow, previousRow
+	}
+	if best.length == 0 {
+		return 0, 0
+	}
+	return best.score, float64(best.matches) / float64(best.length) * 100
+}
+
+// verifyAlignments scores each passage pair with a token-level local alignment and dismisses
+// those below the minimum score or identity
+func verifyAlignments(alignments []Alignment, sourceFilename string, targetFilename string, config *matchingParams) []Alignment {
+	sourceDoc := documentTexts.get(sourceFilename, config.sourceEncoding)
+	targetDoc := documentTexts.get(targetFilename, config.targetEncoding)
+	verifiedAlignments := make([]Alignment, 0, len(alignments))
+	for _, alignment := range alignments {
+		sourceStart, sourceEnd := sourceDoc.cleanRange(alignment.source.startByte, alignment.source.endByte)
+		targetStart, targetEnd := targetDoc.cleanRange(alignment.target.startByte, alignment.target.endByte)
+		alignment.alignmentScore, alignment.identity = localAlignment(sourceDoc.tokensBetween(sourceStart, sourceEnd), targetDoc.tokensBetween(targetStart, targetEnd), config.localAlignmentScores)
+		if alignment.alignmentScore < config.minimumAlignmentScore || alignment.identity < config.minimumIdentity {
+			continue
+		}
+		verifiedAlignments = append(verifiedAlignments, alignment)
+	}
+	return verifiedAlignments
+}
@@ -2,11 +2,15 @@
 """Python package install script"""
 
 import os
+import shutil
 from sys import platform
 
 from setuptools import setup
 
-if platform == "linux":
+if shutil.which("go") is not None:  # build the aligner from source so that it matches the scripts
+    os.system("rm /usr/local/bin/compareNgrams")
+    os.system("cd core/src && go build -o /usr/local/bin/compareNgrams *.go")
+elif platform == "linux":
     os.system("rm /usr/local/bin/compareNgrams")
     os.system("cp core/binary/linux_x64/compareNgrams /usr/local/bin/")
     os.system("chmod +x /usr/local/bin/compareNgrams")
@@ -0,0 +1,71 @@
+"""Tests of ngram generation"""
+
+import json
+import os
+import unittest
+from tempfile import TemporaryDirectory
+
+try:
+    from textpair.generate_ngrams import Ngrams, index_hash_width, index_parameters
+    from textpair.xml_parser import tokenize_line, word_to_json
+except ImportError:  # text preprocessing dependencies are not installed
+    Ngrams = None
+
+TEXT = "In the name of the Father, and of the Son, and of the Holy Ghost, we begin this letter to our beloved brother."
+FORMULA = "in the name of the Father and of the Son"
+
+
+@unittest.skipIf(Ngrams is None, "textpair dependencies are not installed")
+class FormulaNgramsTest(unittest.TestCase):
+    """Formulae must be hashed like the ngram index they are compared to"""
+
+    def build_index(self, path, hash_width):
+        text_path = os.path.join(path, "texts")
+        os.makedirs(text_path)
+        with open(os.path.join(text_path, "0"), "w") as text_file:
+            for word_count, (word, start_byte, end_byte) in enumerate(tokenize_line(TEXT, 0), 1):
+                print(word_to_json(word, start_byte, end_byte, 0, word_count), file=text_file)
+        metadata_file = os.path.join(path, "metadata.json")
+        with open(metadata_file, "w") as metadata:
+            json.dump({"0": {"filename": "0"}}, metadata)
+        index_path = os.path.join(path, "index")
+        ngrams = Ngrams(language="english", stemmer=False, modernize=False, hash_width=hash_width)
+        ngrams.generate(text_path, index_path, metadata=metadata_file, workers=1)
+        with open(os.path.join(index_path, "ngrams", "0.json")) as ngram_file:
+            indexed_ngrams = {int(hashed_ngram) for hashed_ngram in json.load(ngram_file)["ngrams"]}
+        return index_path, indexed_ngrams
+
+    def convert_formula(self, path, ngrams):
+        phrase_file = os.path.join(path, "formulae.txt")
+        with open(phrase_file, "w") as phrases:
+            print(FORMULA, file=phrases)
+        output_file = os.path.join(path, "formulae", "formula.txt")
+        ngrams.formula_ngrams(phrase_file, output_file)
+        with open(output_file) as hashes:
+            return {int(line) for line in hashes if line.strip()}
+
+    def test_formula_round_trip(self):
+        with TemporaryDirectory() as path:
+            _, indexed_ngrams = self.build_index(path, 64)
+            formula_ngrams = self.convert_formula(path, Ngrams(language="english", stemmer=False, modernize=False))
+            self.assertTrue(formula_ngrams)
+            self.assertTrue(formula_ngrams <= indexed_ngrams)
+
+    def test_formula_uses_index_parameters(self):
+        with TemporaryDirectory() as path:
+            index_path, indexed_ngrams = self.build_index(path, 32)
+            self.assertEqual(index_hash_width(index_path), 32)
+            formula_ngrams = self.convert_formula(path, Ngrams(**index_parameters(index_path)))
+            self.assertTrue(formula_ngrams)
+            self.assertTrue(formula_ngrams <= indexed_ngrams)
+
+    def test_legacy_index_hash_width(self):
+        with TemporaryDirectory() as path:
+            os.makedirs(os.path.join(path, "ngrams"))
+            with open(os.path.join(path, "ngrams", "0.json"), "w") as ngram_file:
+                json.dump({"12345": [[0, 0, 10]]}, ngram_file)
+            self.assertEqual(index_hash_width(path), 32)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -5,19 +5,71 @@ import configparser
 import json
 import os
 import sys
+from ast import literal_eval
 from collections import defaultdict
 from glob import glob
 from math import floor
+from tempfile import TemporaryDirectory
 
 from multiprocess import Pool
 from text_preprocessing import PreProcessor, Lemmatizer
 from tqdm import tqdm
 
 from mmh3 import hash as hash32
+from mmh3 import hash64
+
+from .xml_parser import tokenize_line, word_to_json
 
 # https://github.com/tqdm/tqdm/issues/481
 tqdm.monitor_interval = 0
 PHILO_TEXT_OBJECT_LEVELS = {"doc": 1, "div1": 2, "div2": 3, "div3": 4, "para": 5, "sent": 6, "word": 7}
+NGRAM_PARAMETERS = (
+    "text_object_level",
+    "ngram",
+    "gap",
+    "stemmer",
+    "lemmatizer",
+    "stopwords",
+    "numbers",
+    "language",
+    "lowercase",
+    "minimum_word_length",
+    "word_order",
+    "modernize",
+    "pos_to_keep",
+    "hash_width",
+)
+
+
+def index_parameters(ngram_output_path):
+    """Read the preprocessing parameters an ngram index was built with, None if the index has no config"""
+    config_file = os.path.join(ngram_output_path, "config/ngram_config.ini")
+    if not os.path.isfile(config_file):
+        return None
+    ngram_config = configparser.ConfigParser()
+    ngram_config.read(config_file)
+    parameters = {}
+    for param, value in ngram_config["PREPROCESSING"].items():
+        if param not in NGRAM_PARAMETERS:
+            continue
+        if value == "set()":
+            parameters[param] = []
+        else:
+            parameters[param] = literal_eval(value)
+        if isinstance(parameters[param], set):
+            parameters[param] = list(parameters[param])
+    return parameters
+
+
+def index_hash_width(ngram_output_path):
+    """Read the hash width declared in the header of ngram files: files without a header hold 32-bit hashes"""
+    for ngram_file in glob(os.path.join(ngram_output_path, "ngrams", "*.json")):
+        with open(ngram_file) as json_file:
+            header = json.load(json_file).get("header")
+        if header is None:
+            return 32
+        return header["hash_width"]
+    return None
 
 
 class Ngrams:
@@ -38,6 +90,7 @@ class Ngrams:
         word_order=True,
         modernize=True,
         pos_to_keep=[],
+        hash_width=64,
         debug=False,
     ):
         self.config = {
@@ -55,6 +108,7 @@ class Ngrams:
             "stopwords": stopwords,  # TODO: generate error if file not found
             "text_object_level": text_object_level,
             "pos_to_keep": set(pos_to_keep),
+            "hash_width": hash_width,
         }
         self.debug = debug
         self.input_path = ""
@@ -138,9 +192,8 @@ class Ngrams:
         print("Cleaning up...")
         os.system("rm -r {}/temp".format(self.output_path))
 
-    def process_file(self, input_file):
-        """Convert each file into an inverted index of ngrams"""
-        preprocessor = PreProcessor(
+    def __get_preprocessor(self):
+        return PreProcessor(
             language=self.config["language"],
             stemmer=self.config["stemmer"],
             lemmatizer=self.config["lemmatizer"],
@@ -154,14 +207,47 @@ class Ngrams:
             text_object_type=self.config["text_object_level"],
             ascii=True,
         )
+
+    def __hash_ngram(self, ngram):
+        if self.config["hash_width"] == 64:
+            return hash64(ngram)[0]
+        return hash32(ngram)
+
+    def __text_objects(self, preprocessor, input_file, fetch_metadata):
+        text_objects, all_metadata = preprocessor.process_philo_texts(input_file, fetch_metadata=fetch_metadata)
+        for text_object, text_metadata in zip(text_objects, all_metadata):
+            yield preprocessor.format(text_object, text_metadata), text_metadata
+
+    def formula_ngrams(self, phrase_file, output_file):
+        """Convert a list of phrases, one per line, into the list of hashes of their ngrams. Phrases are tokenized
+        like parsed TEI files and go through the same preprocessing as texts, so that hashes match ngram files"""
+        preprocessor = self.__get_preprocessor()
+        hashed_ngrams = set()
+        with open(phrase_file) as phrases, TemporaryDirectory() as words_path:
+            for phrase_id, phrase in enumerate(phrases):
+                phrase = phrase.strip()
+                if not phrase:
+                    continue
+                words_file = os.path.join(words_path, str(phrase_id))
+                with open(words_file, "w") as words:
+                    for word_count, (word, start_byte, end_byte) in enumerate(tokenize_line(phrase, 0), 1):
+                        print(word_to_json(word, start_byte, end_byte, phrase_id, word_count), file=words)
+                for text_object, _ in self.__text_objects(preprocessor, words_file, fetch_metadata=False):
+                    for ngram in text_object:
+                        hashed_ngrams.add(self.__hash_ngram(ngram))
+        if isinstance(preprocessor.lemmatizer, Lemmatizer):  # delete cached lemmatizer file
+            preprocessor.lemmatizer.delete()
+        os.makedirs(os.path.dirname(output_file), exist_ok=True)
+        with open(output_file, "w") as output:
+            output.write("\n".join(str(hashed_ngram) for hashed_ngram in sorted(hashed_ngrams)))
+        return len(hashed_ngrams)
+
+    def process_file(self, input_file):
+        """Convert each file into an inverted index of ngrams"""
+        preprocessor = self.__get_preprocessor()
         doc_ngrams = []
         metadata = {}
-        if self.metadata_done is True:
-            text_objects, all_metadata = preprocessor.process_philo_texts(input_file, fetch_metadata=False)
-        else:
-            text_objects, all_metadata = preprocessor.process_philo_texts(input_file, fetch_metadata=True)
-        for text_object, text_metadata in zip(text_objects, all_metadata):
-            text_object = preprocessor.format(text_object, text_metadata)
+        for text_object, text_metadata in self.__text_objects(preprocessor, input_file, not self.metadata_done):
             # Make sure we only have strings in our metadata:
             for k, v in text_metadata.items():
                 if not isinstance(v, str):
@@ -175,11 +261,15 @@ class Ngrams:
                 text_object_id = os.path.basename(input_file)
             text_index = defaultdict(list)
             for index_pos, ngram in enumerate(text_object):
-                hashed_ngram = hash32(ngram)
+                hashed_ngram = self.__hash_ngram(ngram)
                 text_index[hashed_ngram].append((index_pos, ngram.ext["start_byte"], ngram.ext["end_byte"]))
                 doc_ngrams.append("\t".join((ngram, str(hashed_ngram))))
             with open(f"{self.output_path}/ngrams/{text_object_id}.json", "w") as json_file:
-                json.dump(dict(text_index), json_file)
+                # The header declares hash and offset widths to the aligner: files without one are read as 32-bit
+                json.dump(
+                    {"header": {"hash_width": self.config["hash_width"], "offset_width": 64}, "ngrams": dict(text_index)},
+                    json_file,
+                )
         if isinstance(preprocessor.lemmatizer, Lemmatizer):  # delete cached lemmatizer file
             preprocessor.lemmatizer.delete()
         with open(f"{self.output_path}/temp/{os.path.basename(input_file)}", "w") as output:
@@ -38,7 +38,7 @@ def parse_config(textpair_config, output_path="./output", skip_web_app=False):
                     preprocessing_params["source"]["text_object_level"] = value
                 else:
                     preprocessing_params["target"]["text_object_level"] = value
-            elif key == "ngram" or key == "gap" or key == "minimum_word_length":
+            elif key == "ngram" or key == "gap" or key == "minimum_word_length" or key == "hash_width":
                 preprocessing_params["source"][key] = int(value)
                 preprocessing_params["target"][key] = int(value)
             elif key == "pos_to_keep":
@@ -27,10 +27,10 @@ DEFAULT_FIELD_TYPES = {
     "source_pub_date": "INTEGER",
     "target_year": "INTEGER",
     "target_pub_date": "INTEGER",
-    "source_start_byte": "INTEGER",
-    "target_start_byte": "INTEGER",
-    "source_end_byte": "INTEGER",
-    "target_end_byte": "INTEGER",
+    "source_start_byte": "BIGINT",
+    "target_start_byte": "BIGINT",
+    "source_end_byte": "BIGINT",
+    "target_end_byte": "BIGINT",
     "source_passage_length": "INTEGER",
     "target_passage_length": "INTEGER",
 }
@@ -163,6 +163,8 @@ def validate_field_type(fields, field_types, field_names):
                 value = int(year_match.groups()[0])
             else:
                 value = None
+        elif field_type.upper() == "BIGINT":  # byte offsets can exceed the 32-bit range of INTEGER
+            value = int(value) if value != "" else None
         if field_type == "TEXT" and isinstance(value, str):
             value = clean_text(value)
         values.append(value)
@@ -236,7 +238,7 @@ def load_db(file, table_name, field_types, searchable_fields):
             cursor.execute("CREATE INDEX {}_{}_trigrams_idx ON {} USING GIN({} gin_trgm_ops)".format(field, table_name, table_name, field))
             if not field.endswith("passage"):
                 cursor.execute("CREATE INDEX {}_{}_idx ON {} USING HASH({})".format(field, table_name, table_name, field))
-        elif not field.endswith("year") and field_type == "INTEGER":  # year is a special case used for results ordering
+        elif not field.endswith("year") and field_type in ("INTEGER", "BIGINT"):  # year is a special case used for results ordering
             cursor.execute("CREATE INDEX {}_{}_idx ON {} USING BTREE({})".format(field, table_name, table_name, field))
     cursor.execute("CREATE INDEX year_{}_idx ON {} USING BTREE(source_year, target_year, source_start_byte)".format(table_name, table_name))
     database.commit()
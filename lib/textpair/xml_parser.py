@@ -308,57 +308,55 @@ class TEIParser:
     def word_handler(self, line, bytes_read_in, output_file, file_id, word_count, defined_words_to_index=False, words_to_index=[]):
         """ Word handler. It takes an artbitrary string or words between two tags and
         splits them into words."""
-        # We're splitting the line of words into distinct words separated by "\n"
-        words = TOKEN.sub(r'\n\1\n', line)
-        words = words.replace("'", "\n'\n")  # TODO: account for words that need the apostrophe
-        words = newline_shortener.sub(r'\n', words)
+        for word, start_byte, end_byte in tokenize_line(line, bytes_read_in, words_to_index if defined_words_to_index else None):
+            if self.filter:
+                if word not in self.words_to_keep:
+                    continue
+            word_count += 1
+            print(word_to_json(word, start_byte, end_byte, file_id, word_count), file=output_file)
+        return word_count
 
-        current_pos = bytes_read_in
-        count = 0
-        word_list = words.split('\n')
-        last_word = ""
-        next_word = ""
-        for word in word_list:
-            word_length = len(word.encode('utf8'))
-            try:
-                next_word = word_list[count + 1]
-            except IndexError:
-                pass
-            count += 1
 
-            # Keep track of your bytes since this is where you are getting
-            # the byte offsets for words.
-            current_pos += word_length
+def tokenize_line(line, bytes_read_in, words_to_index=None):
+    """Split an arbitrary string or words between two tags into normalized words along with their start and end bytes"""
+    # We're splitting the line of words into distinct words separated by "\n"
+    words = TOKEN.sub(r'\n\1\n', line)
+    words = words.replace("'", "\n'\n")  # TODO: account for words that need the apostrophe
+    words = newline_shortener.sub(r'\n', words)
+
+    current_pos = bytes_read_in
+    for word in words.split('\n'):
+        # Keep track of your bytes since this is where you are getting
+        # the byte offsets for words.
+        current_pos += len(word.encode('utf8'))
+
+        # Do we have a word? At least one of these characters.
+        if check_if_char_word.search(word.replace('_', "")):
+            word_pos = current_pos - len(word.encode('utf8'))
+            if words_to_index is not None:
+                if word not in words_to_index:
+                    continue
+            if "&" in word:
+                word = convert_entities(word)
 
-            # Do we have a word? At least one of these characters.
-            if check_if_char_word.search(word.replace('_', "")):
-                last_word = word
-                word_pos = current_pos - len(word.encode('utf8'))
-                if defined_words_to_index:
-                    if word not in words_to_index:
-                        continue
+            # You may have some semi-colons...
+            if ";" in word:
                 if "&" in word:
-                    word = convert_entities(word)
+                    pass  # TODO
+                else:
+                    word = semi_colon_strip.sub(r'\1', word)  # strip on both ends
 
-                # You may have some semi-colons...
-                if ";" in word:
-                    if "&" in word:
-                        pass  # TODO
-                    else:
-                        word = semi_colon_strip.sub(r'\1', word)  # strip on both ends
+            word = word.lower()
+            word = control_char_re.sub("", word)
+            word = word.replace("_", "").strip()
+            word = word.replace(' ', '')
+            if len(word):
+                yield word, word_pos, current_pos
 
-                word = word.lower()
-                word = control_char_re.sub("", word)
-                word = word.replace("_", "").strip()
-                word = word.replace(' ', '')
-                if self.filter:
-                    if word not in self.words_to_keep:
-                        continue
-                if len(word):
-                    word_count += 1
-                    word_obj = dumps({"token": word, "start_byte": word_pos, "end_byte": current_pos, "position": "{} 0 0 0 0 0 {}".format(file_id, word_count)})
-                    print(word_obj, file=output_file)
-        return word_count
+
+def word_to_json(word, start_byte, end_byte, file_id, word_count):
+    """Serialize a word as a line of the parsed text files read by the ngram generator"""
+    return dumps({"token": word, "start_byte": start_byte, "end_byte": end_byte, "position": "{} 0 0 0 0 0 {}".format(file_id, word_count)})
 
 
 def main():